@@ -0,0 +1,81 @@
+package amqp
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// OutboxPublisher 发件箱发布适配器,实现database.MessagePublisher,通过database.NewMessagePublisher传入发件箱
+type OutboxPublisher struct {
+	ExchangeKind    string //交换机类型,默认topic
+	ExchangeDurable bool   //交换机持久化,默认true
+	Mandatory       bool   //没有匹配的队列时返回错误,默认false时消息被丢弃
+	client          *Client
+}
+
+// NewOutboxPublisher 创建发件箱发布适配器,client需已调用Keepalive
+func NewOutboxPublisher(client *Client) *OutboxPublisher {
+	return &OutboxPublisher{
+		ExchangeKind:    amqp.ExchangeTopic,
+		ExchangeDurable: true,
+		client:          client,
+	}
+}
+
+/*
+PublishMessage 发布消息到交换机,参数说明:
+
+	1、exchange为发件箱消息的Topic,routingKey为RoutingKey
+	2、messageID写入MessageId,消费者按其幂等处理重复投递
+	3、消息持久化并等待broker确认,确认前ctx结束或broker拒绝时返回错误,发件箱稍后重试
+*/
+func (p *OutboxPublisher) PublishMessage(ctx context.Context, exchange, routingKey, messageID string, body []byte) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if p.client == nil || p.client.amqpConn == nil || p.client.amqpConn.IsClosed() {
+		return errors.New("amqp connection is not available")
+	}
+	var amqpChannel *amqp.Channel
+	if amqpChannel, err = p.client.amqpConn.Channel(); err != nil {
+		return
+	}
+	defer func() {
+		_ = amqpChannel.Close()
+	}()
+	if err = amqpChannel.ExchangeDeclare(exchange, p.ExchangeKind, p.ExchangeDurable, false, false, false, nil); err != nil {
+		return
+	}
+	if err = amqpChannel.Confirm(false); err != nil {
+		return
+	}
+	confirms := amqpChannel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := amqpChannel.NotifyReturn(make(chan amqp.Return, 1))
+	if err = amqpChannel.Publish(exchange, routingKey, p.Mandatory, false, amqp.Publishing{
+		MessageId:    messageID,
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	}); err != nil {
+		return
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case confirm, ok := <-confirms:
+		switch {
+		case !ok:
+			return errors.New("amqp channel closed before confirm")
+		case !confirm.Ack:
+			return errors.Errorf("amqp publish %s nacked", messageID)
+		}
+	}
+	//没有匹配的队列时broker在确认前返回消息,确认到达时已写入returns
+	select {
+	case r := <-returns:
+		return errors.Errorf("amqp publish %s returned: %s", messageID, r.ReplyText)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,373 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+
+	auditPluginName = "database:audit"
+	auditBeforeKey  = "database:audit_before"
+	// AuditTagName 字段标签,audit:"-"的字段不记录,用于密码、密钥等
+	AuditTagName = "audit"
+)
+
+// AuditRecord 审计记录
+type AuditRecord struct {
+	ID         uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Table      string    `gorm:"size:64;index:idx_audit_row,priority:1" json:"table"`        //表名
+	PrimaryKey string    `gorm:"size:128;index:idx_audit_row,priority:2" json:"primary_key"` //主键值,联合主键以逗号分隔
+	Action     string    `gorm:"size:16" json:"action"`                                      //create|update|delete
+	Before     string    `json:"before"`                                                     //变更前数据,json
+	After      string    `json:"after"`                                                      //变更后数据,json
+	Diff       string    `json:"diff"`                                                       //变更字段,json,{"列名":{"before":旧值,"after":新值}}
+	Operator   string    `gorm:"size:64;index" json:"operator"`                              //操作人
+	RequestID  string    `gorm:"size:64" json:"request_id"`                                  //请求ID
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`                                    //操作时间
+}
+
+// AuditSink 审计记录输出,如写入日志、消息队列
+type AuditSink interface {
+	Write(ctx context.Context, records []AuditRecord) error
+}
+
+// AuditSinkFunc 函数适配AuditSink
+type AuditSinkFunc func(ctx context.Context, records []AuditRecord) error
+
+func (f AuditSinkFunc) Write(ctx context.Context, records []AuditRecord) error {
+	return f(ctx, records)
+}
+
+// AuditConfig 审计配置
+type AuditConfig struct {
+	Table        string    //审计表名,默认audit_record,与数据变更在同一事务中写入
+	Sink         AuditSink //不为空时写入Sink,不写审计表
+	Exclude      []string  //全局不记录的列名,如password
+	OperatorKey  string    //未使用WithOperator时,从ctx读取操作人的key,默认operator,gin.Context可直接读取c.Set的值
+	RequestIDKey string    //未使用WithRequestID时,从ctx读取请求ID的key,默认request_id
+	Encrypted    bool      //记录serializer:encrypt的加密字段,默认不记录,记录时为明文
+}
+
+type (
+	operatorCtxKey  struct{}
+	requestIDCtxKey struct{}
+)
+
+// WithOperator ctx附加操作人
+func WithOperator(ctx context.Context, operator string) context.Context {
+	return context.WithValue(ctx, operatorCtxKey{}, operator)
+}
+
+// WithRequestID ctx附加请求ID
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey{}, requestID)
+}
+
+// audit 审计插件,只记录注册的模型
+type audit struct {
+	l *zap.Logger
+	AuditConfig
+	models  map[reflect.Type]bool
+	exclude map[string]bool
+}
+
+// auditRow 变更前的数据
+type auditRow struct {
+	key     string
+	primary []interface{}
+	values  map[string]interface{}
+}
+
+/*
+UseAudit 注册审计插件,参数说明:
+
+	1、models需要审计的模型,通过模型、模型切片或Table+Model执行的增删改均会记录,原生SQL不记录
+	2、未配置Sink时自动创建审计表
+	3、写入审计失败时本次变更返回错误,默认事务中一同回滚
+	4、audit:"-"、Exclude中的列及加密字段不记录
+*/
+func UseAudit(l *zap.Logger, db *gorm.DB, config AuditConfig, models ...interface{}) (err error) {
+	if config.Table == "" {
+		config.Table = "audit_record"
+	}
+	if config.OperatorKey == "" {
+		config.OperatorKey = "operator"
+	}
+	if config.RequestIDKey == "" {
+		config.RequestIDKey = "request_id"
+	}
+	a := &audit{
+		l:           l,
+		AuditConfig: config,
+		models:      make(map[reflect.Type]bool, len(models)),
+		exclude:     make(map[string]bool, len(config.Exclude)),
+	}
+	cacheStore := &sync.Map{}
+	for _, model := range models {
+		var s *schema.Schema
+		if s, err = schema.Parse(model, cacheStore, db.NamingStrategy); err != nil {
+			return
+		}
+		//没有主键时无法定位变更前后的数据
+		if len(s.PrimaryFields) == 0 {
+			return errors.Errorf("audit: model %s has no primary key", s.Name)
+		}
+		a.models[s.ModelType] = true
+	}
+	for _, name := range config.Exclude {
+		a.exclude[name] = true
+	}
+	if config.Sink == nil {
+		if err = migrator(db).Table(config.Table).AutoMigrate(&AuditRecord{}); err != nil {
+			return
+		}
+	}
+	return db.Use(a)
+}
+
+func (a *audit) Name() string {
+	return auditPluginName
+}
+
+func (a *audit) Initialize(db *gorm.DB) (err error) {
+	cb := db.Callback()
+	for _, register := range []func() error{
+		func() error { return cb.Update().Before("gorm:update").Register(auditBeforeKey, a.before) },
+		func() error { return cb.Delete().Before("gorm:delete").Register(auditBeforeKey, a.before) },
+		func() error { return cb.Create().After("gorm:create").Register("database:audit_create", a.afterCreate) },
+		func() error { return cb.Update().After("gorm:update").Register("database:audit_update", a.afterUpdate) },
+		func() error { return cb.Delete().After("gorm:delete").Register("database:audit_delete", a.afterDelete) },
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (a *audit) enabled(db *gorm.DB) bool {
+	return db.Error == nil && !db.DryRun && db.Statement.Schema != nil && a.models[db.Statement.Schema.ModelType]
+}
+
+// before 修改、删除前按语句条件查询变更前的数据
+func (a *audit) before(db *gorm.DB) {
+	if !a.enabled(db) {
+		return
+	}
+	stmt := db.Statement
+	var exprs []clause.Expression
+	if where, ok := stmt.Clauses["WHERE"]; ok {
+		if w, ok := where.Expression.(clause.Where); ok {
+			exprs = append(exprs, w.Exprs...)
+		}
+	}
+	exprs = append(exprs, primaryConditions(stmt)...)
+	if len(exprs) <= 0 && !db.AllowGlobalUpdate {
+		return
+	}
+	tx := db.Session(&gorm.Session{NewDB: true}).Model(reflect.New(stmt.Schema.ModelType).Interface()).Table(stmt.Table)
+	if stmt.Unscoped {
+		tx = tx.Unscoped()
+	}
+	if len(exprs) > 0 {
+		tx = tx.Where(clause.And(exprs...))
+	}
+	rows := reflect.New(reflect.SliceOf(stmt.Schema.ModelType))
+	if err := tx.Find(rows.Interface()).Error; err != nil {
+		_ = db.AddError(errors.Wrapf(err, "audit: query before %s", stmt.Table))
+		return
+	}
+	db.Statement.Settings.Store(auditBeforeKey, a.snapshot(stmt, rows.Elem()))
+}
+
+// primaryConditions 模型值中非零的主键条件,与gorm修改、删除时追加的条件一致,联合主键按多列IN
+func primaryConditions(stmt *gorm.Statement) (exprs []clause.Expression) {
+	_, values := schema.GetIdentityFieldValuesMap(stmt.Context, stmt.ReflectValue, stmt.Schema.PrimaryFields)
+	if len(values) > 0 {
+		column, queryValues := schema.ToQueryValues(clause.CurrentTable, stmt.Schema.PrimaryFieldDBNames, values)
+		exprs = append(exprs, clause.IN{Column: column, Values: queryValues})
+	}
+	return
+}
+
+// snapshot 按列名记录数据,忽略排除的列
+func (a *audit) snapshot(stmt *gorm.Statement, rows reflect.Value) (result []auditRow) {
+	for i := 0; i < rows.Len(); i++ {
+		row := reflect.Indirect(rows.Index(i))
+		if row.Kind() != reflect.Struct {
+			continue
+		}
+		values := make(map[string]interface{}, len(stmt.Schema.DBNames))
+		var (
+			keys    []string
+			primary []interface{}
+		)
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			value, _ := field.ValueOf(stmt.Context, row)
+			if field.PrimaryKey {
+				keys = append(keys, fmt.Sprint(value))
+				primary = append(primary, value)
+			}
+			if a.exclude[field.DBName] || field.Tag.Get(AuditTagName) == "-" {
+				continue
+			}
+			if !a.Encrypted && strings.EqualFold(field.TagSettings["SERIALIZER"], EncryptSerializer) {
+				continue
+			}
+			values[field.DBName] = value
+		}
+		result = append(result, auditRow{key: strings.Join(keys, ","), primary: primary, values: values})
+	}
+	return
+}
+
+func (a *audit) afterCreate(db *gorm.DB) {
+	if !a.enabled(db) {
+		return
+	}
+	var records []AuditRecord
+	for _, row := range a.snapshot(db.Statement, rowsOf(db.Statement.ReflectValue)) {
+		records = append(records, a.record(db, AuditCreate, row.key, nil, row.values, nil))
+	}
+	a.write(db, records)
+}
+
+func (a *audit) afterUpdate(db *gorm.DB) {
+	v, ok := db.Statement.Settings.LoadAndDelete(auditBeforeKey)
+	if !ok || !a.enabled(db) {
+		return
+	}
+	before := v.([]auditRow)
+	if len(before) <= 0 {
+		return
+	}
+	//按主键查询变更后的数据
+	stmt := db.Statement
+	keys := make([][]interface{}, 0, len(before))
+	for _, row := range before {
+		keys = append(keys, row.primary)
+	}
+	column, values := schema.ToQueryValues(clause.CurrentTable, stmt.Schema.PrimaryFieldDBNames, keys)
+	rows := reflect.New(reflect.SliceOf(stmt.Schema.ModelType))
+	if err := db.Session(&gorm.Session{NewDB: true}).Table(stmt.Table).Unscoped().
+		Where(clause.IN{Column: column, Values: values}).Find(rows.Interface()).Error; err != nil {
+		_ = db.AddError(errors.Wrapf(err, "audit: query after %s", stmt.Table))
+		return
+	}
+	after := make(map[string]map[string]interface{}, len(before))
+	for _, row := range a.snapshot(stmt, rows.Elem()) {
+		after[row.key] = row.values
+	}
+	var records []AuditRecord
+	for _, row := range before {
+		diff := make(map[string]interface{})
+		for name, old := range row.values {
+			if current := after[row.key][name]; !jsonEqual(old, current) {
+				diff[name] = map[string]interface{}{"before": old, "after": current}
+			}
+		}
+		if len(diff) > 0 {
+			records = append(records, a.record(db, AuditUpdate, row.key, row.values, after[row.key], diff))
+		}
+	}
+	a.write(db, records)
+}
+
+func (a *audit) afterDelete(db *gorm.DB) {
+	v, ok := db.Statement.Settings.LoadAndDelete(auditBeforeKey)
+	if !ok || !a.enabled(db) {
+		return
+	}
+	var records []AuditRecord
+	for _, row := range v.([]auditRow) {
+		records = append(records, a.record(db, AuditDelete, row.key, row.values, nil, nil))
+	}
+	a.write(db, records)
+}
+
+func (a *audit) record(db *gorm.DB, action, key string, before, after map[string]interface{}, diff map[string]interface{}) AuditRecord {
+	record := AuditRecord{
+		Table:      db.Statement.Table,
+		PrimaryKey: key,
+		Action:     action,
+		Before:     marshalAudit(before),
+		After:      marshalAudit(after),
+		Diff:       marshalAudit(diff),
+		CreatedAt:  time.Now(),
+	}
+	if ctx := db.Statement.Context; ctx != nil {
+		record.Operator = contextString(ctx, operatorCtxKey{}, a.OperatorKey)
+		record.RequestID = contextString(ctx, requestIDCtxKey{}, a.RequestIDKey)
+	}
+	return record
+}
+
+// write 写入审计表或Sink,失败时本次变更返回错误
+func (a *audit) write(db *gorm.DB, records []AuditRecord) {
+	if len(records) <= 0 {
+		return
+	}
+	var err error
+	if a.Sink != nil {
+		err = a.Sink.Write(db.Statement.Context, records)
+	} else {
+		//使用当前语句的连接,事务中与数据变更一同提交或回滚
+		err = db.Session(&gorm.Session{NewDB: true}).Table(a.Table).Create(&records).Error
+	}
+	if err != nil {
+		a.l.Error("写入审计记录失败", zap.String("table", db.Statement.Table), zap.Error(err))
+		_ = db.AddError(errors.Wrap(err, "audit"))
+	}
+}
+
+func rowsOf(v reflect.Value) reflect.Value {
+	v = reflect.Indirect(v)
+	if v.Kind() == reflect.Struct {
+		rows := reflect.MakeSlice(reflect.SliceOf(v.Type()), 0, 1)
+		return reflect.Append(rows, v)
+	}
+	return v
+}
+
+func contextString(ctx context.Context, typed interface{}, key string) string {
+	if v, ok := ctx.Value(typed).(string); ok {
+		return v
+	}
+	if v := ctx.Value(key); v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+func marshalAudit(v map[string]interface{}) string {
+	if v == nil {
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// jsonEqual 按json序列化结果比较,避免时间精度、指针等差异
+func jsonEqual(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+var (
+	models     []interface{}
+	modelsLock sync.Mutex
+	// destructiveDDL 可能丢失数据的DDL:删除、重命名、修改列类型,sqlite修改列时会重建表,只匹配语句结构,表名可带引号
+	destructiveDDL = regexp.MustCompile(`(?i)^\s*(DROP\s|TRUNCATE\s|EXEC(UTE)?\s+sp_rename\b|ALTER\s+TABLE\s+(IF\s+EXISTS\s+)?(ONLY\s+)?` +
+		`("[^"]*"|\x60[^\x60]*\x60|\[[^\]]*\]|[^\s"\x60\[]+)+\s+(DROP|RENAME|MODIFY|CHANGE|ALTER\s+COLUMN)\b)`)
+	// ddlLiteral DDL中的字符串字面量
+	ddlLiteral = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+)
+
+// RegisterModels 注册需要自动迁移的模型,SetupDatabase在开启auto_migrate时迁移
+func RegisterModels(dst ...interface{}) {
+	modelsLock.Lock()
+	defer modelsLock.Unlock()
+	models = append(models, dst...)
+}
+
+// RegisteredModels 已注册的模型
+func RegisteredModels() []interface{} {
+	modelsLock.Lock()
+	defer modelsLock.Unlock()
+	return append([]interface{}{}, models...)
+}
+
+/*
+AutoMigrate 迁移已注册的模型,参数说明:
+
+	1、dryRun为true时只记录将要执行的DDL,不做修改
+	2、allowDestructive为false时,若存在删除、重命名、修改列类型等DDL则拒绝迁移
+*/
+func AutoMigrate(l *zap.Logger, db *gorm.DB, dryRun, allowDestructive bool) (err error) {
+	dst := RegisteredModels()
+	if len(dst) <= 0 {
+		return
+	}
+	db = migrator(db)
+	var statements []string
+	if statements, err = PlanMigrate(db, dst...); err != nil {
+		l.Error("生成迁移DDL失败", zap.Error(err))
+		return
+	}
+	var destructive []string
+	for _, statement := range statements {
+		if isDestructive(statement) {
+			destructive = append(destructive, statement)
+		}
+	}
+	if dryRun {
+		for _, statement := range statements {
+			l.Info("迁移DDL(dry-run)", zap.String("sql", statement), zap.Bool("destructive", isDestructive(statement)))
+		}
+		return
+	}
+	if len(destructive) > 0 && !allowDestructive {
+		l.Error("迁移包含破坏性变更,已拒绝", zap.Strings("sql", destructive))
+		return errors.Errorf("auto migrate refused, %d destructive statements: %s", len(destructive), strings.Join(destructive, "; "))
+	}
+	if err = db.AutoMigrate(dst...); err != nil {
+		l.Error("自动迁移失败", zap.Error(err))
+		return
+	}
+	if len(statements) > 0 {
+		l.Info("自动迁移完成", zap.Strings("sql", statements))
+	}
+	return
+}
+
+// isDestructive 去除字符串字面量后判断DDL是否可能丢失数据
+func isDestructive(statement string) bool {
+	return destructiveDDL.MatchString(ddlLiteral.ReplaceAllString(statement, "''"))
+}
+
+// PlanMigrate 返回迁移dst将要执行的DDL,查询照常执行以获取表结构,DDL只记录不执行
+func PlanMigrate(db *gorm.DB, dst ...interface{}) (statements []string, err error) {
+	pool := &dryRunPool{ConnPool: db.Statement.ConnPool, dialector: db.Dialector}
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	//设置Context时会复制Statement,替换ConnPool不影响db
+	tx := db.Session(&gorm.Session{NewDB: true, SkipDefaultTransaction: true, Context: WithPrimary(ctx)})
+	tx.Statement.ConnPool = pool
+	if err = tx.AutoMigrate(dst...); err != nil {
+		return
+	}
+	return pool.statements, nil
+}
+
+// dryRunPool 查询透传,执行语句只记录
+type dryRunPool struct {
+	gorm.ConnPool
+	dialector  gorm.Dialector
+	statements []string
+}
+
+func (p *dryRunPool) ExecContext(_ context.Context, query string, args ...interface{}) (sql.Result, error) {
+	upper := strings.ToUpper(strings.TrimSpace(query))
+	//sqlite重建表时使用的事务保存点,不属于DDL
+	if !strings.HasPrefix(upper, "SAVEPOINT") && !strings.HasPrefix(upper, "RELEASE SAVEPOINT") && !strings.HasPrefix(upper, "ROLLBACK TO SAVEPOINT") {
+		p.statements = append(p.statements, p.dialector.Explain(query, args...))
+	}
+	return driver.RowsAffected(0), nil
+}
+
+func (p *dryRunPool) BeginTx(context.Context, *sql.TxOptions) (gorm.ConnPool, error) {
+	return p, nil
+}
+
+func (p *dryRunPool) Commit() error {
+	return nil
+}
+
+func (p *dryRunPool) Rollback() error {
+	return nil
+}
@@ -0,0 +1,541 @@
+package database
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	cachePluginName = "database:cache"
+	cacheKey        = "database:cache_ttl"
+	noCacheKey      = "database:no_cache"
+)
+
+var (
+	//多个SELECT或JOIN说明语句涉及其他表,只按主表失效会读到旧数据
+	multiTableSQL = regexp.MustCompile(`(?i)\b(select|join)\b`)
+	//命中时从缓存的行构造*sql.Rows,类型转换与查询数据库时一致
+	cacheReplay = sql.OpenDB(cacheConnector{})
+	//列的扫描类型,map结果按扫描类型转换,远程缓存由其他实例写入时按名称查找
+	scanTypes sync.Map
+)
+
+func init() {
+	for _, v := range []interface{}{
+		int8(0), int16(0), int32(0), int64(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), false, "", []byte(nil), time.Time{}, sql.RawBytes(nil),
+		sql.NullInt16{}, sql.NullInt32{}, sql.NullInt64{}, sql.NullFloat64{}, sql.NullBool{}, sql.NullString{}, sql.NullTime{}, sql.NullByte{},
+	} {
+		scanTypes.Store(reflect.TypeOf(v).String(), reflect.TypeOf(v))
+	}
+}
+
+// CacheStore 缓存存储,远程存储(如redis)实现该接口后多实例共享缓存及失效
+type CacheStore interface {
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	// Set 写入缓存,table用于按表失效
+	Set(ctx context.Context, table, key string, value []byte, ttl time.Duration) error
+	// Invalidate 删除表的全部缓存
+	Invalidate(ctx context.Context, table string) error
+}
+
+// CacheConfig 查询缓存配置
+type CacheConfig struct {
+	TTL    time.Duration //缓存时长,默认1分钟
+	Size   int           //进程内LRU最大条目数,默认10000,Store不为空时无效
+	Store  CacheStore    //缓存存储,为空时使用进程内LRU,多实例时其他实例的写入只能等待过期
+	Tables []string      //自动缓存的表,其他表的查询需使用Cached标记
+}
+
+// cacheEntry 缓存的查询结果,保存数据库返回的原始值,命中时重新扫描到Dest
+type cacheEntry struct {
+	Columns []string       //列名
+	Types   []string       //列的扫描类型
+	Rows    [][]cacheValue //行
+}
+
+// cacheValue driver.Value,按类型分别保存以区分NULL、空字符串及空字节
+type cacheValue struct {
+	Kind  uint8 //0:NULL 1:int64 2:float64 3:bool 4:[]byte 5:string 6:time.Time
+	Int   int64
+	Float float64
+	Bool  bool
+	Bytes []byte
+	Str   string
+	Time  time.Time
+}
+
+// queryCache 查询缓存插件,替换gorm:query,命中时不再查询数据库
+type queryCache struct {
+	CacheConfig
+	l      *zap.Logger
+	tables map[string]bool
+	query  func(db *gorm.DB)
+}
+
+/*
+UseCache 注册查询缓存插件,说明:
+
+	1、只缓存通过Find、First、Take等经过查询回调的语句,键为SQL、参数、结果类型及租户
+	2、事务内、带JOIN、子查询或锁的查询不缓存,Raw、Exec不经过该回调
+	3、缓存数据库返回的原始值,命中时与查询数据库时同样扫描,加密字段缓存的是密文
+	4、经过回调的创建、修改、删除使所在表的缓存失效,ctx中有WithTx开启的事务时提交后再次失效
+	5、Raw、Exec写入后需调用InvalidateCache
+	6、启用读写分离时未命中的查询使用主库,保证写入后读到的缓存不是副本上的旧数据
+*/
+func UseCache(l *zap.Logger, db *gorm.DB, config CacheConfig) error {
+	if config.TTL <= 0 {
+		config.TTL = time.Minute
+	}
+	if config.Size <= 0 {
+		config.Size = 10000
+	}
+	if config.Store == nil {
+		config.Store = NewLRUCache(config.Size)
+	}
+	c := &queryCache{CacheConfig: config, l: l, tables: make(map[string]bool)}
+	for _, table := range config.Tables {
+		c.tables[table] = true
+	}
+	return db.Use(c)
+}
+
+// Cached 缓存当前查询,ttl<=0时使用插件的缓存时长
+func Cached(db *gorm.DB, ttl time.Duration) *gorm.DB {
+	return db.Set(cacheKey, ttl)
+}
+
+// NoCache 当前查询不使用缓存
+func NoCache(db *gorm.DB) *gorm.DB {
+	return db.Set(noCacheKey, true)
+}
+
+// InvalidateCache 删除表的缓存,用于Raw、Exec等不经过回调的写入
+func InvalidateCache(ctx context.Context, db *gorm.DB, tables ...string) error {
+	c, ok := db.Config.Plugins[cachePluginName].(*queryCache)
+	if !ok {
+		return nil
+	}
+	for _, table := range tables {
+		if err := c.Store.Invalidate(ctx, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *queryCache) Name() string {
+	return cachePluginName
+}
+
+func (c *queryCache) Initialize(db *gorm.DB) (err error) {
+	cb := db.Callback()
+	if c.query = cb.Query().Get("gorm:query"); c.query == nil {
+		c.query = callbacks.Query
+	}
+	for _, register := range []func() error{
+		func() error { return cb.Query().Replace("gorm:query", c.cached) },
+		func() error { return cb.Create().After("*").Register(cachePluginName, c.invalidate) },
+		func() error { return cb.Update().After("*").Register(cachePluginName, c.invalidate) },
+		func() error { return cb.Delete().After("*").Register(cachePluginName, c.invalidate) },
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// ttl 语句的缓存时长,不缓存时返回0
+func (c *queryCache) ttl(db *gorm.DB) time.Duration {
+	stmt := db.Statement
+	if db.Error != nil || db.DryRun || stmt.Table == "" || reflect.ValueOf(stmt.Dest).Kind() != reflect.Ptr {
+		return 0
+	}
+	if _, ok := stmt.Settings.Load(noCacheKey); ok {
+		return 0
+	}
+	ttl := time.Duration(0)
+	if v, ok := stmt.Settings.Load(cacheKey); ok {
+		if ttl = v.(time.Duration); ttl <= 0 {
+			ttl = c.TTL
+		}
+	} else if c.tables[stmt.Table] {
+		ttl = c.TTL
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	//事务内可能读到未提交的数据
+	if _, ok := stmt.ConnPool.(gorm.TxCommitter); ok {
+		return 0
+	}
+	if len(stmt.Joins) > 0 {
+		return 0
+	}
+	if _, ok := stmt.Clauses["FOR"]; ok {
+		return 0
+	}
+	if from, ok := stmt.Clauses["FROM"].Expression.(clause.From); ok && len(from.Joins) > 0 {
+		return 0
+	}
+	return ttl
+}
+
+// key SQL合并空白后与参数、结果类型及租户计算摘要
+func (c *queryCache) key(db *gorm.DB) string {
+	stmt := db.Statement
+	h := sha1.New()
+	_, _ = fmt.Fprintf(h, "%s\x00%T\x00", strings.Join(strings.Fields(stmt.SQL.String()), " "), stmt.Dest)
+	for _, v := range stmt.Vars {
+		_, _ = fmt.Fprintf(h, "%T:%v\x00", v, v)
+	}
+	if t, ok := db.Config.Plugins[tenantPluginName].(*tenant); ok {
+		if id, skip, err := t.resolve(db); err == nil && !skip {
+			_, _ = fmt.Fprintf(h, "tenant:%s", id)
+		}
+	}
+	return "gorm:cache:" + stmt.Table + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *queryCache) cached(db *gorm.DB) {
+	ttl := c.ttl(db)
+	if ttl <= 0 {
+		c.query(db)
+		return
+	}
+	callbacks.BuildQuerySQL(db)
+	if db.Error != nil {
+		return
+	}
+	stmt := db.Statement
+	if len(multiTableSQL.FindAllStringIndex(stmt.SQL.String(), 2)) > 1 {
+		c.query(db)
+		return
+	}
+	key := c.key(db)
+	if value, ok, err := c.Store.Get(stmt.Context, key); err != nil {
+		c.l.Warn("读取查询缓存失败", zap.String("table", stmt.Table), zap.Error(err))
+	} else if ok {
+		var entry cacheEntry
+		if err = gob.NewDecoder(bytes.NewReader(value)).Decode(&entry); err == nil {
+			c.scan(db, &entry)
+			return
+		}
+		c.l.Warn("解码查询缓存失败", zap.String("table", stmt.Table), zap.Error(err))
+	}
+	//未命中时查询主库,副本复制延迟时写入后失效的缓存会被旧数据重新填充
+	pool := stmt.ConnPool
+	if v, ok := stmt.Settings.Load(replicaKey); ok {
+		pool = v.(*routed).pool
+	}
+	rows, err := pool.QueryContext(stmt.Context, stmt.SQL.String(), stmt.Vars...)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	entry, err := readRows(rows)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	c.scan(db, entry)
+	if db.Error != nil {
+		return
+	}
+	var value bytes.Buffer
+	if err = gob.NewEncoder(&value).Encode(entry); err != nil {
+		c.l.Debug("查询结果不支持缓存", zap.String("table", stmt.Table), zap.Error(err))
+		return
+	}
+	if err = c.Store.Set(stmt.Context, stmt.Table, key, value.Bytes(), ttl); err != nil {
+		c.l.Warn("写入查询缓存失败", zap.String("table", stmt.Table), zap.Error(err))
+	}
+}
+
+// scan 缓存的行按gorm:query的方式扫描到Dest
+func (c *queryCache) scan(db *gorm.DB, entry *cacheEntry) {
+	rows, err := cacheReplay.QueryContext(context.WithValue(context.Background(), cacheEntryCtxKey{}, entry), "")
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	defer func() {
+		_ = db.AddError(rows.Close())
+	}()
+	gorm.Scan(rows, db, 0)
+}
+
+// readRows 读取全部行的原始值并关闭rows
+func readRows(rows *sql.Rows) (entry *cacheEntry, err error) {
+	defer func() {
+		if e := rows.Close(); err == nil {
+			err = e
+		}
+	}()
+	entry = &cacheEntry{}
+	if entry.Columns, err = rows.Columns(); err != nil {
+		return
+	}
+	entry.Types = make([]string, len(entry.Columns))
+	if columnTypes, e := rows.ColumnTypes(); e == nil {
+		for i, columnType := range columnTypes {
+			if scanType := columnType.ScanType(); scanType != nil && i < len(entry.Types) {
+				entry.Types[i] = scanType.String()
+				scanTypes.LoadOrStore(entry.Types[i], scanType)
+			}
+		}
+	}
+	values := make([]interface{}, len(entry.Columns))
+	for rows.Next() {
+		for i := range values {
+			values[i] = new(interface{})
+		}
+		if err = rows.Scan(values...); err != nil {
+			return
+		}
+		row := make([]cacheValue, len(values))
+		for i, v := range values {
+			switch value := (*v.(*interface{})).(type) {
+			case nil:
+			case int64:
+				row[i] = cacheValue{Kind: 1, Int: value}
+			case float64:
+				row[i] = cacheValue{Kind: 2, Float: value}
+			case bool:
+				row[i] = cacheValue{Kind: 3, Bool: value}
+			case []byte:
+				row[i] = cacheValue{Kind: 4, Bytes: value}
+			case string:
+				row[i] = cacheValue{Kind: 5, Str: value}
+			case time.Time:
+				row[i] = cacheValue{Kind: 6, Time: value}
+			default:
+				return nil, errors.Errorf("unsupported driver value %T", value)
+			}
+		}
+		entry.Rows = append(entry.Rows, row)
+	}
+	err = rows.Err()
+	return
+}
+
+type cacheEntryCtxKey struct{}
+
+// cacheConnector 只读的内存驱动,查询返回ctx中的缓存行
+type cacheConnector struct{}
+
+func (cacheConnector) Connect(context.Context) (driver.Conn, error) {
+	return cacheConn{}, nil
+}
+
+func (cacheConnector) Driver() driver.Driver {
+	return cacheDriver{}
+}
+
+type cacheDriver struct{}
+
+func (cacheDriver) Open(string) (driver.Conn, error) {
+	return cacheConn{}, nil
+}
+
+type cacheConn struct{}
+
+func (cacheConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("cache replay: prepare not supported")
+}
+
+func (cacheConn) Close() error {
+	return nil
+}
+
+func (cacheConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("cache replay: transaction not supported")
+}
+
+func (cacheConn) QueryContext(ctx context.Context, _ string, _ []driver.NamedValue) (driver.Rows, error) {
+	entry, ok := ctx.Value(cacheEntryCtxKey{}).(*cacheEntry)
+	if !ok {
+		return nil, errors.New("cache replay: entry missing")
+	}
+	return &cacheRows{entry: entry}, nil
+}
+
+type cacheRows struct {
+	entry *cacheEntry
+	next  int
+}
+
+func (r *cacheRows) Columns() []string {
+	return r.entry.Columns
+}
+
+func (r *cacheRows) Close() error {
+	return nil
+}
+
+func (r *cacheRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.entry.Rows) {
+		return io.EOF
+	}
+	for i, v := range r.entry.Rows[r.next] {
+		switch v.Kind {
+		case 1:
+			dest[i] = v.Int
+		case 2:
+			dest[i] = v.Float
+		case 3:
+			dest[i] = v.Bool
+		case 4:
+			//gob将空字节解码为nil,非NULL的空值需保持非nil
+			if v.Bytes == nil {
+				v.Bytes = []byte{}
+			}
+			dest[i] = v.Bytes
+		case 5:
+			dest[i] = v.Str
+		case 6:
+			dest[i] = v.Time
+		default:
+			dest[i] = nil
+		}
+	}
+	r.next++
+	return nil
+}
+
+func (r *cacheRows) ColumnTypeScanType(index int) reflect.Type {
+	if index < len(r.entry.Types) {
+		if scanType, ok := scanTypes.Load(r.entry.Types[index]); ok {
+			return scanType.(reflect.Type)
+		}
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+// invalidate 写入后使表的缓存失效,事务提交前其他连接可能重新缓存旧数据,提交后再次失效
+func (c *queryCache) invalidate(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || db.DryRun || stmt.Table == "" {
+		return
+	}
+	table := stmt.Table
+	invalidate := func(ctx context.Context) {
+		if err := c.Store.Invalidate(ctx, table); err != nil {
+			c.l.Error("查询缓存失效失败", zap.String("table", table), zap.Error(err))
+		}
+	}
+	invalidate(stmt.Context)
+	if _, ok := stmt.ConnPool.(gorm.TxCommitter); ok {
+		AfterCommit(stmt.Context, invalidate)
+	}
+}
+
+// LRUCache 进程内LRU缓存
+type LRUCache struct {
+	mu     sync.Mutex
+	size   int
+	ll     *list.List
+	items  map[string]*list.Element
+	tables map[string]map[string]struct{}
+}
+
+type lruItem struct {
+	key       string
+	table     string
+	value     []byte
+	expiresAt time.Time
+}
+
+// NewLRUCache 创建最多size条的LRU缓存
+func NewLRUCache(size int) *LRUCache {
+	return &LRUCache{
+		size:   size,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		tables: make(map[string]map[string]struct{}),
+	}
+}
+
+func (c *LRUCache) Get(_ context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	item := e.Value.(*lruItem)
+	if time.Now().After(item.expiresAt) {
+		c.remove(e)
+		return nil, false, nil
+	}
+	c.ll.MoveToFront(e)
+	return item.value, true, nil
+}
+
+func (c *LRUCache) Set(_ context.Context, table, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+	c.items[key] = c.ll.PushFront(&lruItem{key: key, table: table, value: value, expiresAt: time.Now().Add(ttl)})
+	if c.tables[table] == nil {
+		c.tables[table] = make(map[string]struct{})
+	}
+	c.tables[table][key] = struct{}{}
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+	return nil
+}
+
+func (c *LRUCache) Invalidate(_ context.Context, table string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.tables[table] {
+		if e, ok := c.items[key]; ok {
+			c.remove(e)
+		}
+	}
+	delete(c.tables, table)
+	return nil
+}
+
+// Len 缓存条目数
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+func (c *LRUCache) remove(e *list.Element) {
+	item := e.Value.(*lruItem)
+	c.ll.Remove(e)
+	delete(c.items, item.key)
+	if keys, ok := c.tables[item.table]; ok {
+		delete(keys, item.key)
+		if len(keys) == 0 {
+			delete(c.tables, item.table)
+		}
+	}
+}
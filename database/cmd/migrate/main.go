@@ -0,0 +1,127 @@
+// migrate 版本化迁移命令行
+//
+//	migrate -driver sqlite -dsn ./app.db -dir ./migrations up
+//	migrate -driver mysql -dsn "user:pass@tcp(127.0.0.1:3306)/db?parseTime=True" -dir ./migrations down 1
+//
+// 子命令: up | down [步数,默认1] | to <版本号> | status | validate
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/awp0816/infrastructure/database"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run 解析参数并执行子命令,输出写入out,便于使用sqlite测试
+func run(ctx context.Context, args []string, out io.Writer) (err error) {
+	var (
+		flags = flag.NewFlagSet("migrate", flag.ContinueOnError)
+		dbCfg database.Database
+		dir   = flags.String("dir", "migrations", "迁移文件目录")
+		table = flags.String("table", "schema_migrations", "迁移历史表")
+	)
+	flags.SetOutput(out)
+	flags.StringVar(&dbCfg.Driver, "driver", "sqlite", "数据库驱动名称")
+	flags.StringVar(&dbCfg.Dsn, "dsn", "", "连接字符串")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() <= 0 {
+		flags.Usage()
+		return errors.New("missing command: up|down|to|status|validate")
+	}
+	//迁移占用一个连接,另一个用于迁移锁续期
+	dbCfg.MaxIdleConns, dbCfg.MaxOpenConns = 2, 2
+
+	var l *zap.Logger
+	if l, err = zap.NewDevelopment(); err != nil {
+		return
+	}
+	defer l.Sync()
+	db, err := database.SetupDatabase(ctx, l, dbCfg)
+	if err != nil {
+		return
+	}
+	if sqldb, e := db.DB(); e == nil {
+		defer sqldb.Close()
+	}
+	migrator := database.NewMigrator(l, db)
+	migrator.Table = *table
+	migrator.LockTable = *table + "_lock"
+	if err = migrator.LoadFS(os.DirFS(*dir), "."); err != nil {
+		return
+	}
+
+	command, params := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(params) > 0 {
+			if steps, err = strconv.Atoi(params[0]); err != nil {
+				return
+			}
+		}
+		return migrator.Down(ctx, steps)
+	case "to":
+		if len(params) <= 0 {
+			return errors.New("missing target version")
+		}
+		var version int64
+		if version, err = strconv.ParseInt(params[0], 10, 64); err != nil {
+			return
+		}
+		return migrator.To(ctx, version)
+	case "status":
+		var status []database.MigrationStatus
+		if status, err = migrator.Status(ctx); err != nil {
+			return
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tAPPLIED AT")
+		for _, s := range status {
+			state, appliedAt := "pending", ""
+			switch {
+			case s.Missing:
+				state = "missing"
+			case s.Modified:
+				state = "modified"
+			case s.Applied:
+				state = "applied"
+			}
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Name, state, appliedAt)
+		}
+		return w.Flush()
+	case "validate":
+		if err = migrator.Validate(ctx); err != nil {
+			return
+		}
+		fmt.Fprintln(out, "ok")
+		return
+	default:
+		return errors.Errorf("unknown command: %s", command)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeMigrations(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		tmp  = t.TempDir()
+		dir  = filepath.Join(tmp, "migrations")
+		dsn  = filepath.Join(tmp, "app.db")
+		base = []string{"-driver", "sqlite", "-dsn", dsn, "-dir", dir}
+	)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeMigrations(t, dir, map[string]string{
+		"1_create_user.up.sql":   "CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT);",
+		"1_create_user.down.sql": "DROP TABLE user;",
+		"2_create_post.up.sql":   "CREATE TABLE post (id INTEGER PRIMARY KEY, title TEXT); INSERT INTO post (title) VALUES ('a;b');",
+		"2_create_post.down.sql": "DROP TABLE post;",
+	})
+	exec := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := run(ctx, append(append([]string{}, base...), args...), &out)
+		return out.String(), err
+	}
+	states := func() []string {
+		t.Helper()
+		out, err := exec("status")
+		if err != nil {
+			t.Fatalf("status: %v", err)
+		}
+		var result []string
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n")[1:] {
+			result = append(result, strings.Fields(line)[2])
+		}
+		return result
+	}
+
+	if got := strings.Join(states(), ","); got != "pending,pending" {
+		t.Fatalf("status before up = %s", got)
+	}
+	if _, err := exec("up"); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if got := strings.Join(states(), ","); got != "applied,applied" {
+		t.Fatalf("status after up = %s", got)
+	}
+	if out, err := exec("validate"); err != nil || strings.TrimSpace(out) != "ok" {
+		t.Fatalf("validate = %q, %v", out, err)
+	}
+
+	//修改已执行的迁移
+	writeMigrations(t, dir, map[string]string{"2_create_post.up.sql": "CREATE TABLE post (id INTEGER PRIMARY KEY);"})
+	if _, err := exec("validate"); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("validate modified = %v", err)
+	}
+	if got := strings.Join(states(), ","); got != "applied,modified" {
+		t.Fatalf("status after modify = %s", got)
+	}
+
+	if _, err := exec("down"); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	if got := strings.Join(states(), ","); got != "applied,pending" {
+		t.Fatalf("status after down = %s", got)
+	}
+	if _, err := exec("validate"); err != nil {
+		t.Fatalf("validate after down: %v", err)
+	}
+	if _, err := exec("down", "5"); err != nil {
+		t.Fatalf("down 5: %v", err)
+	}
+	if got := strings.Join(states(), ","); got != "pending,pending" {
+		t.Fatalf("status after down all = %s", got)
+	}
+
+	if _, err := exec("unknown"); err == nil {
+		t.Fatal("unknown command should fail")
+	}
+}
@@ -1,102 +1,255 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
-	"gorm.io/driver/mysql"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
+	"math/rand"
+	"regexp"
 	"time"
 )
 
 type Database struct {
-	Driver       string `yaml:"driver"`
-	Dsn          string `yaml:"dsn"`
-	Debug        bool   `yaml:"debug"`
-	MaxIdleConns int    `yaml:"idleConn"`
-	MaxOpenConns int    `yaml:"openConn"`
-	MaxLifeTime  int    `yaml:"lifeTime"`
-	AutoMigrate  bool   `yaml:"auto_migrate"`
+	Driver            string           `yaml:"driver"`
+	Dsn               string           `yaml:"dsn"`
+	Debug             bool             `yaml:"debug"`
+	MaxIdleConns      int              `yaml:"idleConn"`
+	MaxOpenConns      int              `yaml:"openConn"`
+	MaxLifeTime       int              `yaml:"lifeTime"`
+	AutoMigrate       bool             `yaml:"auto_migrate"`
+	MigrateDryRun     bool             `yaml:"migrate_dry_run"`     //迁移时只记录DDL,不执行
+	AllowDestructive  bool             `yaml:"allow_destructive"`   //迁移时允许删除、重命名、修改列类型等破坏性变更
+	Replicas          []string         `yaml:"replicas"`            //只读副本连接字符串,查询路由到副本,写入及事务使用主库
+	ReplicaPolicy     string           `yaml:"replica_policy"`      //副本负载均衡策略,random|round_robin|least_conn,默认random
+	ReplicaCheck      int              `yaml:"replica_check"`       //副本健康检查间隔,单位秒,默认10
+	LogLevel          string           `yaml:"log_level"`           //sql日志等级,silent|error|warn|info,默认warn,debug为true时为info
+	SlowThreshold     int              `yaml:"slow_threshold"`      //慢查询阈值,单位毫秒,默认200,小于0时不记录
+	ParameterizedSQL  bool             `yaml:"parameterized_sql"`   //日志只记录带占位符的SQL,不记录参数
+	LogContextKeys    []string         `yaml:"log_context_keys"`    //从ctx中读取并写入sql日志的字段,如request_id
+	SlowExplain       bool             `yaml:"slow_explain"`        //mysql、sqlite慢查询时记录EXPLAIN执行计划
+	ExplainInterval   int              `yaml:"explain_interval"`    //同一语句执行EXPLAIN的最小间隔,单位秒,默认60
+	Name              string           `yaml:"name"`                //连接名称,用于指标的db标签,默认default,多数据库时为配置名称
+	Metrics           bool             `yaml:"metrics"`             //注册Prometheus指标,连接池统计及按表、操作统计的语句次数与耗时
+	ConnectRetries    int              `yaml:"connect_retries"`     //连接失败重试次数,默认0不重试
+	ConnectBackoff    int              `yaml:"connect_backoff"`     //首次重试等待时间,单位毫秒,默认500,之后每次翻倍
+	ConnectMaxBackoff int              `yaml:"connect_max_backoff"` //最大重试等待时间,单位毫秒,默认10000
+	ConnectTimeout    int              `yaml:"connect_timeout"`     //连接及重试的总时长,单位秒,默认不限制
+	StatementTimeout  int              `yaml:"statement_timeout"`   //默认语句超时,单位毫秒,ctx没有截止时间的语句使用,默认0不限制
+	Cache             bool             `yaml:"cache"`               //启用查询缓存,写入经过回调时按表失效
+	CacheTTL          int              `yaml:"cache_ttl"`           //缓存时长,单位秒,默认60
+	CacheSize         int              `yaml:"cache_size"`          //进程内缓存最大条目数,默认10000
+	CacheTables       []string         `yaml:"cache_tables"`        //自动缓存的表,其他表的查询需使用Cached标记
+	SQLite            SQLiteConfig     `yaml:"sqlite"`              //sqlite连接选项
+	Encryption        EncryptionConfig `yaml:"encryption"`          //字段加密密钥,配置keys后注册serializer:encrypt
 }
 
-func SetupDatabase(l *zap.Logger, inParams Database) (dbConn *gorm.DB, err error) {
-	switch inParams.Driver {
-	case "mysql":
-		if dbConn, err = gorm.Open(mysql.Open(inParams.Dsn), &gorm.Config{
+/*
+SetupDatabase 创建数据库连接,参数说明:
+
+	1、ctx结束时停止重试并返回,如服务关闭
+	2、连接失败时按connect_retries重试,等待时间从connect_backoff开始翻倍并加入随机抖动,connect_timeout为全部重试的总时长
+*/
+func SetupDatabase(ctx context.Context, l *zap.Logger, inParams Database) (dbConn *gorm.DB, err error) {
+	driver, ok := lookupDriver(inParams.Driver)
+	if !ok {
+		err = errors.Errorf("unsupported database:%s", inParams.Driver)
+		return
+	}
+	var level logger.LogLevel
+	if level, err = ParseLogLevel(inParams.LogLevel); err != nil {
+		return
+	}
+	slow := time.Duration(inParams.SlowThreshold) * time.Millisecond
+	if inParams.SlowThreshold == 0 {
+		slow = 200 * time.Millisecond
+	} else if inParams.SlowThreshold < 0 {
+		slow = 0
+	}
+	if inParams.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(inParams.ConnectTimeout)*time.Second)
+		defer cancel()
+	}
+	backoff := time.Duration(inParams.ConnectBackoff) * time.Millisecond
+	if backoff <= 0 {
+		backoff = 500 * time.Millisecond
+	}
+	maxBackoff := time.Duration(inParams.ConnectMaxBackoff) * time.Millisecond
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+	dsn := MaskDSN(inParams.Dsn)
+	for attempt := 1; ; attempt++ {
+		l.Info("连接数据库", zap.String("driver", inParams.Driver), zap.String("dsn", dsn), zap.Int("attempt", attempt))
+		if dbConn, err = connect(ctx, l, driver, inParams, &gorm.Config{
 			//迁移时是否禁用外键约束
 			DisableForeignKeyConstraintWhenMigrating: true,
 			//命名策略
 			NamingStrategy: schema.NamingStrategy{
 				SingularTable: true, // 使用单数表名，启用该选项，此时，`User` 的表名应该是 `user`
 			},
-			Logger: logger.Default.LogMode(logger.Warn),
+			Logger: NewLogger(l, LoggerConfig{
+				Level:                level,
+				ParameterizedQueries: inParams.ParameterizedSQL,
+				ContextKeys:          inParams.LogContextKeys,
+			}),
+		}); err == nil {
+			break
+		}
+		if attempt > inParams.ConnectRetries {
+			return
+		}
+		//等待时间在[backoff/2, backoff)之间随机
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		l.Warn("连接数据库失败,等待重试", zap.String("dsn", dsn), zap.Int("attempt", attempt), zap.Duration("wait", wait), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			err = errors.Wrapf(ctx.Err(), "connect %s after %d attempts: %v", dsn, attempt, err)
+			return
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	//连接成功后的初始化出错时关闭主库及副本连接,避免连接池泄漏
+	defer func() {
+		if err != nil {
+			_ = CloseDatabase(dbConn)
+			dbConn = nil
+		}
+	}()
+	if err = UseOptimisticLock(dbConn); err != nil {
+		l.Error("注册乐观锁插件失败", zap.Error(err))
+		return
+	}
+	if err = UseStatementTimeout(dbConn, time.Duration(inParams.StatementTimeout)*time.Millisecond); err != nil {
+		l.Error("注册语句超时插件失败", zap.Error(err))
+		return
+	}
+	//慢查询由插件统计,gorm日志不再重复记录
+	if slow > 0 {
+		if err = UseSlowQuery(l, dbConn, SlowQueryConfig{
+			Threshold:            slow,
+			Explain:              inParams.SlowExplain,
+			ExplainInterval:      time.Duration(inParams.ExplainInterval) * time.Second,
+			ParameterizedQueries: inParams.ParameterizedSQL,
 		}); err != nil {
-			l.Error("创建mysql连接失败", zap.Error(err))
+			l.Error("注册慢查询插件失败", zap.Error(err))
 			return
 		}
-	case "sqlite":
-		if dbConn, err = gorm.Open(sqlite.Open(inParams.Dsn), &gorm.Config{
-			//迁移时是否禁用外键约束
-			DisableForeignKeyConstraintWhenMigrating: true,
-			//命名策略
-			NamingStrategy: schema.NamingStrategy{
-				SingularTable: true, // 使用单数表名，启用该选项，此时，`User` 的表名应该是 `user`
-			},
-			Logger: logger.Default.LogMode(logger.Warn),
+	}
+
+	//sqlite单写连接,查询路由到同一数据库的读连接池
+	if inParams.Driver == "sqlite" && inParams.SQLite.SingleWriter {
+		inParams.Replicas = append([]string{inParams.Dsn}, inParams.Replicas...)
+	}
+	if len(inParams.Replicas) > 0 {
+		if err = useReplicas(l, dbConn, driver, inParams); err != nil {
+			return
+		}
+	}
+
+	if inParams.Metrics {
+		name := inParams.Name
+		if name == "" {
+			name = "default"
+		}
+		if err = UseMetrics(dbConn, name, nil); err != nil {
+			l.Error("注册数据库指标失败", zap.Error(err))
+			return
+		}
+	}
+
+	if inParams.Cache {
+		if err = UseCache(l, dbConn, CacheConfig{
+			TTL:    time.Duration(inParams.CacheTTL) * time.Second,
+			Size:   inParams.CacheSize,
+			Tables: inParams.CacheTables,
 		}); err != nil {
-			l.Error("创建sqlite连接失败", zap.Error(err))
+			l.Error("注册查询缓存插件失败", zap.Error(err))
 			return
 		}
-		if err = dbConn.Exec("PRAGMA journal_mode=WAL;").Error; err != nil {
+	}
+
+	//模型解析时校验序列化器,需在迁移前注册
+	if len(inParams.Encryption.Keys) > 0 {
+		var k *Keyring
+		if k, err = ParseKeyring(inParams.Encryption); err != nil {
+			l.Error("加载字段加密密钥失败", zap.Error(err))
+			return
+		}
+		if err = UseEncryption(dbConn, k); err != nil {
+			l.Error("注册字段加密插件失败", zap.Error(err))
 			return
 		}
-	default:
-		err = errors.Errorf("unsupported database:%s", inParams.Driver)
-		return
 	}
 
-	dbAction(dbConn, l)
+	if inParams.AutoMigrate {
+		if err = AutoMigrate(l, dbConn, inParams.MigrateDryRun, inParams.AllowDestructive); err != nil {
+			return
+		}
+	}
 
+	if inParams.Debug {
+		dbConn = dbConn.Debug()
+	}
+	return
+}
+
+// connect 打开连接、执行驱动初始化并PING,失败时关闭已打开的连接
+func connect(ctx context.Context, l *zap.Logger, driver Driver, inParams Database, config *gorm.Config) (dbConn *gorm.DB, err error) {
+	dsn := MaskDSN(inParams.Dsn)
+	if dbConn, err = gorm.Open(driver.dialector(inParams.Dsn, inParams), config); err != nil {
+		l.Error("创建数据库连接失败", zap.String("driver", inParams.Driver), zap.String("dsn", dsn), zap.Error(err))
+		return
+	}
 	var sqldb *sql.DB
 	if sqldb, err = dbConn.DB(); err != nil {
 		l.Error("获取连接池DB失败", zap.Error(err))
 		return
 	}
-	if err = sqldb.Ping(); err != nil {
-		l.Error("PING连接池DB失败", zap.Error(err))
-		return
-	}
+	defer func() {
+		if err != nil {
+			_ = sqldb.Close()
+		}
+	}()
 	//设置空闲连接池中连接的最大数量
 	sqldb.SetMaxIdleConns(inParams.MaxIdleConns)
 	//设置打开数据库连接的最大数量
 	sqldb.SetMaxOpenConns(inParams.MaxOpenConns)
 	//设置打开数据库的连接最大存活时间
 	sqldb.SetConnMaxLifetime(time.Second * time.Duration(inParams.MaxLifeTime))
-
-	if inParams.Debug {
-		dbConn = dbConn.Debug()
+	if driver.Init != nil {
+		if err = driver.Init(dbConn.WithContext(ctx), inParams); err != nil {
+			l.Error("数据库初始化失败", zap.String("driver", inParams.Driver), zap.String("dsn", dsn), zap.Error(err))
+			return
+		}
+	}
+	if err = sqldb.PingContext(ctx); err != nil {
+		l.Error("PING连接池DB失败", zap.String("dsn", dsn), zap.Error(err))
+		return
 	}
 	return
 }
 
-func dbAction(db *gorm.DB, l *zap.Logger) {
-	_ = db.Callback().Create().After("gorm:after_create").Register("log", afterLog(l))
-	_ = db.Callback().Query().After("gorm:after_query").Register("log", afterLog(l))
-	_ = db.Callback().Delete().After("gorm:after_delete").Register("log", afterLog(l))
-	_ = db.Callback().Update().After("gorm:after_update").Register("log", afterLog(l))
-	_ = db.Callback().Raw().After("gorm:raw").Register("log", afterLog(l))
-}
+var (
+	dsnURLPassword = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*://[^:/@]*):([^@]*)@`)
+	dsnUserinfo    = regexp.MustCompile(`^([^:@/()]*):(.*)@([a-z]*\(|/)`)
+	dsnKeyPassword = regexp.MustCompile(`(?i)\b(password|pwd)(\s*=\s*)('[^']*'|[^\s;&]*)`)
+)
 
-func afterLog(l *zap.Logger) func(*gorm.DB) {
-	return func(db *gorm.DB) {
-		err := db.Error
-		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-			sqlStr := db.Dialector.Explain(db.Statement.SQL.String(), db.Statement.Vars...)
-			l.Error("Sql执行出错", zap.Error(err), zap.String("error_sql", sqlStr))
-			return
-		}
+// MaskDSN 隐藏连接字符串中的密码,支持mysql、url及key=value格式
+func MaskDSN(dsn string) string {
+	switch {
+	case dsnURLPassword.MatchString(dsn):
+		dsn = dsnURLPassword.ReplaceAllString(dsn, "$1:***@")
+	case dsnUserinfo.MatchString(dsn):
+		dsn = dsnUserinfo.ReplaceAllString(dsn, "$1:***@$3")
 	}
+	return dsnKeyPassword.ReplaceAllString(dsn, "$1$2***")
 }
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"sort"
+	"sync"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/mattn/go-sqlite3"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/pkg/errors"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/driver/sqlserver"
+	"gorm.io/gorm"
+)
+
+// Driver 数据库驱动,Open创建gorm方言,Dialector按配置创建方言,不为空时代替Open,Init在连接创建后执行驱动相关的初始化语句,Retryable判断错误可否重试事务,除Open外均可为空
+type Driver struct {
+	Open      func(dsn string) gorm.Dialector
+	Dialector func(dsn string, inParams Database) gorm.Dialector
+	Init      func(db *gorm.DB, inParams Database) error
+	Retryable func(err error) bool
+}
+
+var (
+	driversLock sync.RWMutex
+	drivers     = map[string]Driver{
+		"mysql": {Open: mysql.Open, Retryable: func(err error) bool {
+			//1213死锁,1205锁等待超时
+			var e *mysqlDriver.MySQLError
+			return errors.As(err, &e) && (e.Number == 1213 || e.Number == 1205)
+		}},
+		"sqlite": {Open: sqlite.Open, Dialector: sqliteDialector, Init: sqliteInit, Retryable: func(err error) bool {
+			var e sqlite3.Error
+			return errors.As(err, &e) && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked)
+		}},
+		"postgres": {Open: postgres.Open, Retryable: func(err error) bool {
+			//40001序列化失败,40P01死锁
+			var e *pgconn.PgError
+			return errors.As(err, &e) && (e.Code == "40001" || e.Code == "40P01")
+		}},
+		"sqlserver": {Open: sqlserver.Open, Retryable: func(err error) bool {
+			//1205死锁牺牲品
+			var e mssql.Error
+			return errors.As(err, &e) && e.Number == 1205
+		}},
+	}
+)
+
+// RegisterDriver 注册数据库驱动,同名驱动会被覆盖,可用于接入达梦、人大金仓等信创数据库
+func RegisterDriver(name string, driver Driver) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+	drivers[name] = driver
+}
+
+// Drivers 已注册的驱动名称
+func Drivers() (names []string) {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+func (d Driver) dialector(dsn string, inParams Database) gorm.Dialector {
+	if d.Dialector != nil {
+		return d.Dialector(dsn, inParams)
+	}
+	return d.Open(dsn)
+}
+
+func lookupDriver(name string) (driver Driver, ok bool) {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	driver, ok = drivers[name]
+	return
+}
@@ -0,0 +1,441 @@
+package database
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	encryptPluginName = "database:encrypt"
+	// EncryptSerializer 加密序列化器名称,字段使用gorm:"serializer:encrypt"
+	EncryptSerializer = "encrypt"
+	// BlindIndexTag 盲索引标签,gorm:"serializer:encrypt;blind_index:phone_hash"写入时将明文的HMAC写入phone_hash列
+	BlindIndexTag = "BLIND_INDEX"
+)
+
+// EncryptionConfig 字段加密配置,密钥为base64编码
+type EncryptionConfig struct {
+	KeyID    string            `yaml:"key_id"`    //加密使用的密钥ID
+	Keys     map[string]string `yaml:"keys"`      //密钥ID到AES密钥(16/24/32字节),轮换时新增密钥并修改key_id,旧密钥保留用于解密
+	IndexKey string            `yaml:"index_key"` //盲索引HMAC密钥,修改后已有的盲索引失效
+}
+
+// Keyring 字段加密密钥
+type Keyring struct {
+	current  string
+	aeads    map[string]cipher.AEAD
+	indexKey []byte
+}
+
+var (
+	keyringLock sync.RWMutex
+	keyring     *Keyring
+)
+
+/*
+NewKeyring 创建密钥,参数说明:
+
+	1、current加密使用的密钥ID,需在keys中,ID不能包含冒号
+	2、keys密钥ID到AES密钥,解密时按密文中的密钥ID选择
+	3、indexKey盲索引HMAC密钥,为空时不支持盲索引
+*/
+func NewKeyring(current string, keys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	k := &Keyring{current: current, aeads: make(map[string]cipher.AEAD), indexKey: indexKey}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, errors.Errorf("invalid encryption key id:%q", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "encryption key %s", id)
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, errors.Wrapf(err, "encryption key %s", id)
+		}
+	}
+	if _, ok := k.aeads[current]; !ok {
+		return nil, errors.Errorf("encryption key %s not found", current)
+	}
+	return k, nil
+}
+
+// ParseKeyring 按配置创建密钥
+func ParseKeyring(config EncryptionConfig) (*Keyring, error) {
+	keys := make(map[string][]byte, len(config.Keys))
+	for id, encoded := range config.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode encryption key %s", id)
+		}
+		keys[id] = key
+	}
+	var indexKey []byte
+	if config.IndexKey != "" {
+		var err error
+		if indexKey, err = base64.StdEncoding.DecodeString(config.IndexKey); err != nil {
+			return nil, errors.Wrap(err, "decode index key")
+		}
+	}
+	return NewKeyring(config.KeyID, keys, indexKey)
+}
+
+// Encrypt 使用当前密钥加密,密文格式为 {密钥ID}:{base64(nonce+密文)}
+func (k *Keyring) Encrypt(plaintext []byte) (string, error) {
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return k.current + ":" + base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// Decrypt 按密文中的密钥ID解密
+func (k *Keyring) Decrypt(ciphertext string) ([]byte, error) {
+	id, encoded, ok := strings.Cut(ciphertext, ":")
+	if !ok {
+		return nil, errors.New("invalid ciphertext")
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, errors.Errorf("encryption key %s not found", id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ciphertext")
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("invalid ciphertext")
+	}
+	return aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+}
+
+// NeedsRotation 密文是否使用非当前密钥加密,重新保存数据即使用当前密钥加密
+func (k *Keyring) NeedsRotation(ciphertext string) bool {
+	id, _, _ := strings.Cut(ciphertext, ":")
+	return id != k.current
+}
+
+// BlindIndex 明文的HMAC-SHA256,用于等值查询,空值返回空字符串
+func (k *Keyring) BlindIndex(plaintext string) string {
+	if plaintext == "" || len(k.indexKey) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(plaintext))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// BlindIndex 使用UseEncryption注册的密钥计算盲索引,查询时 Eq("phone_hash", database.BlindIndex(phone))
+func BlindIndex(plaintext string) string {
+	if k := currentKeyring(); k != nil {
+		return k.BlindIndex(plaintext)
+	}
+	return ""
+}
+
+func currentKeyring() *Keyring {
+	keyringLock.RLock()
+	defer keyringLock.RUnlock()
+	return keyring
+}
+
+/*
+UseEncryption 注册加密序列化器及字段加密插件,说明:
+
+	1、序列化器全局生效,多个连接使用同一密钥
+	2、字段为string、[]byte时加密原始内容,其他类型加密JSON
+	3、blind_index标签指定的列在创建及更新时写入明文的HMAC,需为模型中的字段
+	4、Updates(map)、Update(列, 值)写入加密字段时同样加密,Where条件中的值不加密,需使用盲索引查询
+	5、Select指定了源字段时盲索引列一同更新
+	6、审计默认不记录加密字段,查询缓存保存的是密文
+*/
+func UseEncryption(db *gorm.DB, k *Keyring) error {
+	keyringLock.Lock()
+	keyring = k
+	keyringLock.Unlock()
+	schema.RegisterSerializer(EncryptSerializer, encryptSerializer{})
+	if _, ok := db.Config.Plugins[encryptPluginName]; ok {
+		return nil
+	}
+	return db.Use(&fieldEncryption{})
+}
+
+// encryptSerializer AES-GCM加密序列化器
+type encryptSerializer struct{}
+
+func (encryptSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) (err error) {
+	fieldValue := reflect.New(field.FieldType)
+	if dbValue != nil {
+		var ciphertext string
+		switch v := dbValue.(type) {
+		case []byte:
+			ciphertext = string(v)
+		case string:
+			ciphertext = v
+		default:
+			return errors.Errorf("failed to decrypt value: %#v", dbValue)
+		}
+		if ciphertext != "" {
+			k := currentKeyring()
+			if k == nil {
+				return errors.New("encryption keyring not registered")
+			}
+			var plaintext []byte
+			if plaintext, err = k.Decrypt(ciphertext); err != nil {
+				return errors.Wrapf(err, "decrypt %s.%s", field.Schema.Table, field.DBName)
+			}
+			if err = decodePlaintext(plaintext, fieldValue); err != nil {
+				return
+			}
+		}
+	}
+	field.ReflectValueOf(ctx, dst).Set(fieldValue.Elem())
+	return
+}
+
+func (encryptSerializer) Value(_ context.Context, field *schema.Field, _ reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, null, err := encodePlaintext(fieldValue)
+	if err != nil || null {
+		return nil, err
+	}
+	k := currentKeyring()
+	if k == nil {
+		return nil, errors.New("encryption keyring not registered")
+	}
+	ciphertext, err := k.Encrypt(plaintext)
+	if err != nil {
+		return nil, errors.Wrapf(err, "encrypt %s.%s", field.Schema.Table, field.DBName)
+	}
+	return ciphertext, nil
+}
+
+// encodePlaintext 字段值转为明文,nil指针返回null
+func encodePlaintext(value interface{}) (plaintext []byte, null bool, err error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), false, nil
+	case []byte:
+		return v, v == nil, nil
+	case *string:
+		if v == nil {
+			return nil, true, nil
+		}
+		return []byte(*v), false, nil
+	}
+	if rv := reflect.ValueOf(value); !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+		return nil, true, nil
+	}
+	plaintext, err = json.Marshal(value)
+	return
+}
+
+func decodePlaintext(plaintext []byte, fieldValue reflect.Value) error {
+	switch dest := fieldValue.Interface().(type) {
+	case *string:
+		*dest = string(plaintext)
+	case *[]byte:
+		*dest = plaintext
+	case **string:
+		s := string(plaintext)
+		*dest = &s
+	default:
+		return json.Unmarshal(plaintext, dest)
+	}
+	return nil
+}
+
+// fieldEncryption 写入前计算盲索引,并加密map中的加密字段,gorm写入map时不经过序列化器
+type fieldEncryption struct{}
+
+func (e *fieldEncryption) Name() string {
+	return encryptPluginName
+}
+
+func (e *fieldEncryption) Initialize(db *gorm.DB) (err error) {
+	cb := db.Callback()
+	for _, register := range []func() error{
+		//在BeforeCreate、BeforeUpdate之后,乐观锁生成SET子句之前
+		func() error {
+			return cb.Create().Before("gorm:save_before_associations").Register(encryptPluginName, e.prepare)
+		},
+		func() error {
+			return cb.Update().Before("gorm:save_before_associations").Register(encryptPluginName, e.prepare)
+		},
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (e *fieldEncryption) prepare(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.Schema == nil {
+		return
+	}
+	k := currentKeyring()
+	if k == nil {
+		return
+	}
+	var encrypted []*schema.Field
+	for _, field := range stmt.Schema.Fields {
+		if strings.EqualFold(field.TagSettings["SERIALIZER"], EncryptSerializer) {
+			encrypted = append(encrypted, field)
+		}
+		name, ok := field.TagSettings[BlindIndexTag]
+		if !ok {
+			continue
+		}
+		target := stmt.Schema.LookUpField(name)
+		if target == nil {
+			_ = db.AddError(errors.Errorf("blind index field %s not found in %s", name, stmt.Schema.Name))
+			return
+		}
+		selectIndex(stmt, field, target)
+		if err := e.index(stmt, k, field, target); err != nil {
+			_ = db.AddError(err)
+			return
+		}
+	}
+	if len(encrypted) > 0 {
+		_ = db.AddError(eachMap(stmt, func(values map[string]interface{}) error {
+			for _, field := range encrypted {
+				keys := []string{field.DBName}
+				if field.Name != field.DBName {
+					keys = append(keys, field.Name)
+				}
+				for _, key := range keys {
+					v, ok := values[key]
+					if _, expr := v.(clause.Expression); !ok || expr {
+						continue
+					}
+					plaintext, null, err := encodePlaintext(v)
+					if err != nil {
+						return err
+					}
+					if null {
+						values[key] = nil
+					} else if values[key], err = k.Encrypt(plaintext); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}))
+	}
+}
+
+// selectIndex Select指定了源字段而没有盲索引列时追加,否则盲索引不会更新
+func selectIndex(stmt *gorm.Statement, source, target *schema.Field) {
+	if len(stmt.Selects) == 0 {
+		return
+	}
+	selected := false
+	for _, name := range stmt.Selects {
+		switch name {
+		case "*", target.Name, target.DBName:
+			return
+		case source.Name, source.DBName:
+			selected = true
+		}
+	}
+	if selected {
+		stmt.Selects = append(stmt.Selects, target.DBName)
+	}
+}
+
+// eachMap Dest为map时对每个map执行fn
+func eachMap(stmt *gorm.Statement, fn func(values map[string]interface{}) error) error {
+	switch dest := stmt.Dest.(type) {
+	case map[string]interface{}:
+		return fn(dest)
+	case *map[string]interface{}:
+		return fn(*dest)
+	case []map[string]interface{}:
+		for _, values := range dest {
+			if err := fn(values); err != nil {
+				return err
+			}
+		}
+	case *[]map[string]interface{}:
+		for _, values := range *dest {
+			if err := fn(values); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// index 按写入的数据设置盲索引,Dest为map时只处理包含源字段的map
+func (e *fieldEncryption) index(stmt *gorm.Statement, k *Keyring, source, target *schema.Field) error {
+	index := func(value interface{}) (string, error) {
+		plaintext, null, err := encodePlaintext(value)
+		if err != nil || null {
+			return "", err
+		}
+		return k.BlindIndex(string(plaintext)), nil
+	}
+	switch stmt.Dest.(type) {
+	case map[string]interface{}, *map[string]interface{}, []map[string]interface{}, *[]map[string]interface{}:
+		return eachMap(stmt, func(values map[string]interface{}) error {
+			for _, key := range []string{source.DBName, source.Name} {
+				if v, ok := values[key]; ok {
+					value, err := index(v)
+					if err != nil {
+						return err
+					}
+					values[target.DBName] = value
+				}
+			}
+			return nil
+		})
+	}
+	assign := func(rv reflect.Value) error {
+		rv = reflect.Indirect(rv)
+		if rv.Kind() != reflect.Struct || rv.Type() != stmt.Schema.ModelType {
+			return nil
+		}
+		value, err := index(source.ReflectValueOf(stmt.Context, rv).Interface())
+		if err != nil {
+			return err
+		}
+		return target.Set(stmt.Context, rv, value)
+	}
+	rv := reflect.Indirect(reflect.ValueOf(stmt.Dest))
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if err := assign(rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		//Updates(struct)传入的值不可寻址时复制后替换Dest
+		if !rv.CanAddr() {
+			addr := reflect.New(rv.Type())
+			addr.Elem().Set(rv)
+			stmt.Dest = addr.Interface()
+			rv = addr.Elem()
+		}
+		return assign(rv)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Filter 查询条件,由Eq、In、And、Or等组合,列名按标识符转义,值均作为参数传递
+type Filter struct {
+	expr  clause.Expression
+	order []clause.OrderByColumn
+}
+
+func column(name string) clause.Column {
+	return clause.Column{Name: name}
+}
+
+// Eq 等于,value为nil时为IS NULL
+func Eq(name string, value interface{}) Filter {
+	return Filter{expr: clause.Eq{Column: column(name), Value: value}}
+}
+
+// Ne 不等于,value为nil时为IS NOT NULL
+func Ne(name string, value interface{}) Filter {
+	return Filter{expr: clause.Neq{Column: column(name), Value: value}}
+}
+
+// Gt 大于
+func Gt(name string, value interface{}) Filter {
+	return Filter{expr: clause.Gt{Column: column(name), Value: value}}
+}
+
+// Gte 大于等于
+func Gte(name string, value interface{}) Filter {
+	return Filter{expr: clause.Gte{Column: column(name), Value: value}}
+}
+
+// Lt 小于
+func Lt(name string, value interface{}) Filter {
+	return Filter{expr: clause.Lt{Column: column(name), Value: value}}
+}
+
+// Lte 小于等于
+func Lte(name string, value interface{}) Filter {
+	return Filter{expr: clause.Lte{Column: column(name), Value: value}}
+}
+
+// In 在列表中,列表为空时条件不成立
+func In[V any](name string, values ...V) Filter {
+	vars := make([]interface{}, len(values))
+	for i, v := range values {
+		vars[i] = v
+	}
+	return Filter{expr: clause.IN{Column: column(name), Values: vars}}
+}
+
+// NotIn 不在列表中
+func NotIn[V any](name string, values ...V) Filter {
+	return Not(In(name, values...))
+}
+
+// Like 模糊匹配,pattern需自行包含%
+func Like(name string, pattern string) Filter {
+	return Filter{expr: clause.Like{Column: column(name), Value: pattern}}
+}
+
+// Between 闭区间
+func Between(name string, from, to interface{}) Filter {
+	return Filter{expr: clause.Expr{SQL: "? BETWEEN ? AND ?", Vars: []interface{}{column(name), from, to}}}
+}
+
+// IsNull 为空
+func IsNull(name string) Filter {
+	return Eq(name, nil)
+}
+
+// NotNull 不为空
+func NotNull(name string) Filter {
+	return Ne(name, nil)
+}
+
+// Expr 原生条件,用于其他构造函数无法表达的场景
+func Expr(sql string, vars ...interface{}) Filter {
+	return Filter{expr: clause.Expr{SQL: sql, Vars: vars}}
+}
+
+// And 同时满足,排序合并
+func And(filters ...Filter) Filter {
+	var f Filter
+	exprs := make([]clause.Expression, 0, len(filters))
+	for _, filter := range filters {
+		if filter.expr != nil {
+			exprs = append(exprs, filter.expr)
+		}
+		f.order = append(f.order, filter.order...)
+	}
+	if len(exprs) > 0 {
+		f.expr = clause.And(exprs...)
+	}
+	return f
+}
+
+// Or 满足任一,排序合并
+func Or(filters ...Filter) Filter {
+	var f Filter
+	exprs := make([]clause.Expression, 0, len(filters))
+	for _, filter := range filters {
+		if filter.expr != nil {
+			exprs = append(exprs, filter.expr)
+		}
+		f.order = append(f.order, filter.order...)
+	}
+	if len(exprs) > 0 {
+		f.expr = clause.Or(exprs...)
+	}
+	return f
+}
+
+// Not 取反
+func Not(filter Filter) Filter {
+	if filter.expr != nil {
+		filter.expr = clause.Not(filter.expr)
+	}
+	return filter
+}
+
+// Asc 按列升序,可与条件一同传入
+func Asc(name string) Filter {
+	return Filter{order: []clause.OrderByColumn{{Column: column(name)}}}
+}
+
+// Desc 按列降序
+func Desc(name string) Filter {
+	return Filter{order: []clause.OrderByColumn{{Column: column(name), Desc: true}}}
+}
+
+// Apply 将条件及排序应用到db
+func (f Filter) Apply(db *gorm.DB) *gorm.DB {
+	if f.expr != nil {
+		db = db.Where(f.expr)
+	}
+	if len(f.order) > 0 {
+		db = db.Order(clause.OrderBy{Columns: f.order})
+	}
+	return db
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GinDBKey gin.Context中保存绑定请求的*gorm.DB的键
+const GinDBKey = "database:db"
+
+// ginContext 取消及截止时间来自请求,值优先读取gin.Context,c.Set的租户、request_id等对插件及日志可见
+type ginContext struct {
+	context.Context
+	c *gin.Context
+}
+
+func (g ginContext) Value(key interface{}) interface{} {
+	if v := g.c.Value(key); v != nil {
+		return v
+	}
+	return g.Context.Value(key)
+}
+
+/*
+GinMiddleware 请求上下文绑定到gorm会话,参数说明:
+
+	1、handler通过GinDB获取绑定的*gorm.DB,客户端断开或超时时正在执行的语句被取消
+	2、timeout大于0时为请求设置截止时间,截止时间内的语句不再使用默认语句超时
+*/
+func GinMiddleware(db *gorm.DB, timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			c.Request = c.Request.WithContext(ctx)
+		}
+		c.Set(GinDBKey, db.WithContext(ginContext{Context: ctx, c: c}))
+		c.Next()
+	}
+}
+
+// GinDB 返回GinMiddleware绑定请求的*gorm.DB,未使用中间件时返回nil
+func GinDB(c *gin.Context) *gorm.DB {
+	if v, ok := c.Get(GinDBKey); ok {
+		if db, ok := v.(*gorm.DB); ok {
+			return db
+		}
+	}
+	return nil
+}
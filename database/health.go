@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// HealthStatus 连接健康状态
+type HealthStatus struct {
+	Healthy  bool          `json:"healthy"`            //是否可用
+	Latency  time.Duration `json:"latency"`            //PING耗时,纳秒
+	Error    string        `json:"error,omitempty"`    //错误信息
+	Replicas []bool        `json:"replicas,omitempty"` //各副本是否可用,按配置顺序
+	Stats    sql.DBStats   `json:"stats"`              //连接池统计
+}
+
+// HealthChecker 检查多个连接,可直接作为/healthz的http.Handler,gin中使用gin.WrapH
+type HealthChecker struct {
+	Timeout time.Duration //单个连接检查超时,默认3秒
+	lock    sync.RWMutex
+	dbs     map[string]*gorm.DB
+}
+
+// NewHealthChecker 创建健康检查
+func NewHealthChecker(timeout time.Duration) *HealthChecker {
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	return &HealthChecker{Timeout: timeout, dbs: make(map[string]*gorm.DB)}
+}
+
+// Add 添加需要检查的连接,同名覆盖
+func (h *HealthChecker) Add(name string, db *gorm.DB) *HealthChecker {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.dbs[name] = db
+	return h
+}
+
+// Check 并发检查全部连接,全部可用时healthy为true
+func (h *HealthChecker) Check(ctx context.Context) (healthy bool, result map[string]HealthStatus) {
+	h.lock.RLock()
+	names := make([]string, 0, len(h.dbs))
+	for name := range h.dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dbs := make([]*gorm.DB, len(names))
+	for i, name := range names {
+		dbs[i] = h.dbs[name]
+	}
+	h.lock.RUnlock()
+
+	statuses := make([]HealthStatus, len(names))
+	var wg sync.WaitGroup
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = CheckHealth(ctx, dbs[i], h.Timeout)
+		}(i)
+	}
+	wg.Wait()
+	healthy = true
+	result = make(map[string]HealthStatus, len(names))
+	for i, name := range names {
+		result[name] = statuses[i]
+		healthy = healthy && statuses[i].Healthy
+	}
+	return
+}
+
+// ServeHTTP 全部可用时返回200,否则返回503,内容为各连接的状态
+func (h *HealthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	healthy, result := h.Check(r.Context())
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if healthy {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"healthy":   healthy,
+		"databases": result,
+	})
+}
+
+// CheckHealth 在timeout内PING主库,并返回副本状态及连接池统计
+func CheckHealth(ctx context.Context, db *gorm.DB, timeout time.Duration) (status HealthStatus) {
+	sqldb, err := db.DB()
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	begin := time.Now()
+	err = sqldb.PingContext(ctx)
+	status.Latency = time.Since(begin)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Healthy = true
+	}
+	status.Stats = sqldb.Stats()
+	if plugin, ok := db.Config.Plugins[replicaPluginName]; ok {
+		for _, r := range plugin.(*replicaSet).replicas {
+			status.Replicas = append(status.Replicas, r.healthy.Load())
+		}
+	}
+	return
+}
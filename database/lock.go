@@ -0,0 +1,296 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrLockHeld 锁被其他持有者占用且未过期
+	ErrLockHeld = errors.New("lock held by another owner")
+	// ErrLockLost 租约已过期并被其他持有者获取,或已释放
+	ErrLockLost = errors.New("lock lost")
+)
+
+// LockRecord 分布式锁,每个锁名称一行,释放后保留以保证fencing token递增
+type LockRecord struct {
+	Name      string    `gorm:"primaryKey;size:128" json:"name"` //锁名称
+	Owner     string    `gorm:"size:255" json:"owner"`           //持有者,释放后为空
+	Token     int64     `json:"token"`                           //fencing token,每次获取加1
+	ExpiresAt time.Time `json:"expires_at"`                      //租约到期时间
+	UpdatedAt time.Time `json:"updated_at"`                      //最近一次获取或续约时间
+}
+
+// Locker 基于数据库租约的分布式锁,租约到期依赖各实例时钟一致,ttl应远大于时钟偏差
+type Locker struct {
+	Table string //锁表,默认distributed_lock
+	Owner string //持有者前缀,默认主机名-进程号-启动时间,每次获取再追加序号
+	l     *zap.Logger
+	db    *gorm.DB
+	seq   uint64
+}
+
+// NewLocker 创建分布式锁
+func NewLocker(l *zap.Logger, db *gorm.DB) *Locker {
+	host, _ := os.Hostname()
+	return &Locker{
+		Table: "distributed_lock",
+		Owner: fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+		l:     l,
+		db:    db,
+	}
+}
+
+// Migrate 创建锁表
+func (m *Locker) Migrate() error {
+	return migrator(m.db).Table(m.Table).AutoMigrate(&LockRecord{})
+}
+
+// session 锁语句不加入ctx中的事务,并强制使用主库
+func (m *Locker) session(ctx context.Context) *gorm.DB {
+	return m.db.WithContext(WithPrimary(ctx)).Table(m.Table)
+}
+
+// Acquire 获取锁,锁被占用且未过期时返回ErrLockHeld,同一进程内的多次获取同样互斥
+func (m *Locker) Acquire(ctx context.Context, name string, ttl time.Duration) (lease *Lease, err error) {
+	if ttl <= 0 {
+		return nil, errors.New("lock ttl must be positive")
+	}
+	owner := fmt.Sprintf("%s-%d", m.Owner, atomic.AddUint64(&m.seq, 1))
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	//已过期或已释放的锁由新持有者接管
+	result := m.session(ctx).Where("name = ? AND (owner = '' OR expires_at < ?)", name, now).Updates(map[string]interface{}{
+		"owner":      owner,
+		"token":      gorm.Expr("token + 1"),
+		"expires_at": expiresAt,
+		"updated_at": now,
+	})
+	if err = result.Error; err != nil {
+		return
+	}
+	if result.RowsAffected == 0 {
+		result = m.session(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(&LockRecord{
+			Name:      name,
+			Owner:     owner,
+			Token:     1,
+			ExpiresAt: expiresAt,
+			UpdatedAt: now,
+		})
+		if err = result.Error; err != nil {
+			return
+		}
+		if result.RowsAffected == 0 {
+			return nil, errors.Wrap(ErrLockHeld, name)
+		}
+	}
+	var record LockRecord
+	if err = m.session(ctx).Where("name = ? AND owner = ?", name, owner).Take(&record).Error; err != nil {
+		return
+	}
+	return &Lease{
+		Name:      name,
+		Owner:     owner,
+		Token:     record.Token,
+		ttl:       ttl,
+		locker:    m,
+		expiresAt: expiresAt,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+/*
+Do 持有锁时执行fn,参数说明:
+
+	1、锁被占用时返回ErrLockHeld,不执行fn
+	2、执行期间后台自动续约,租约丢失时取消fn的ctx
+	3、fn返回后释放锁
+*/
+func (m *Locker) Do(ctx context.Context, name string, ttl time.Duration, fn func(ctx context.Context) error) (err error) {
+	var lease *Lease
+	if lease, err = m.Acquire(ctx, name, ttl); err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lease.KeepAlive(ctx, func(lease *Lease, err error) {
+		m.l.Error("分布式锁租约丢失", zap.String("name", lease.Name), zap.Int64("token", lease.Token), zap.Error(err))
+		cancel()
+	})
+	defer func() {
+		//ctx可能已取消,释放使用独立的ctx
+		releaseCtx, releaseCancel := context.WithTimeout(context.Background(), lease.ttl)
+		defer releaseCancel()
+		if e := lease.Release(releaseCtx); e != nil && !errors.Is(e, ErrLockLost) {
+			m.l.Warn("分布式锁释放失败", zap.String("name", lease.Name), zap.Error(e))
+		}
+	}()
+	return fn(ctx)
+}
+
+/*
+Job 包装定时任务,多实例中同一时刻只有获得锁的实例执行,用于timer.AddTask:
+
+	_ = t.AddTask("report", "0 * * * *", "daily_report", locker.Job("daily_report", time.Minute, func(ctx context.Context) error {
+		return report(ctx)
+	}))
+*/
+func (m *Locker) Job(name string, ttl time.Duration, fn func(ctx context.Context) error) func() {
+	return func() {
+		err := m.Do(context.Background(), name, ttl, fn)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrLockHeld):
+			m.l.Debug("定时任务已在其他实例执行", zap.String("name", name))
+		default:
+			m.l.Error("定时任务执行失败", zap.String("name", name), zap.Error(err))
+		}
+	}
+}
+
+// Lease 锁租约
+type Lease struct {
+	Name      string //锁名称
+	Owner     string //持有者
+	Token     int64  //fencing token,写入外部资源时携带,资源拒绝小于已见过的token的写入
+	ttl       time.Duration
+	locker    *Locker
+	mu        sync.Mutex
+	expiresAt time.Time
+	done      chan struct{}
+	once      sync.Once
+	err       error
+}
+
+// ExpiresAt 租约到期时间
+func (l *Lease) ExpiresAt() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.expiresAt
+}
+
+// Done 租约丢失或释放时关闭
+func (l *Lease) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err Done关闭后返回原因,释放时为nil
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// finish 结束租约,只有第一次调用生效
+func (l *Lease) finish(err error) {
+	l.once.Do(func() {
+		l.mu.Lock()
+		l.err = err
+		l.mu.Unlock()
+		close(l.done)
+	})
+}
+
+// Renew 续约ttl,锁已被其他持有者获取或已释放时返回ErrLockLost
+func (l *Lease) Renew(ctx context.Context) error {
+	select {
+	case <-l.done:
+		return errors.Wrap(ErrLockLost, l.Name)
+	default:
+	}
+	now := time.Now()
+	expiresAt := now.Add(l.ttl)
+	result := l.locker.session(ctx).Where("name = ? AND owner = ? AND token = ?", l.Name, l.Owner, l.Token).Updates(map[string]interface{}{
+		"expires_at": expiresAt,
+		"updated_at": now,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		err := errors.Wrap(ErrLockLost, l.Name)
+		l.finish(err)
+		return err
+	}
+	l.mu.Lock()
+	l.expiresAt = expiresAt
+	l.mu.Unlock()
+	return nil
+}
+
+// Release 释放锁,保留记录及token,锁已丢失时返回ErrLockLost
+func (l *Lease) Release(ctx context.Context) error {
+	select {
+	case <-l.done:
+		if err := l.Err(); err != nil {
+			return err
+		}
+		return nil
+	default:
+	}
+	result := l.locker.session(ctx).Where("name = ? AND owner = ? AND token = ?", l.Name, l.Owner, l.Token).Updates(map[string]interface{}{
+		"owner":      "",
+		"expires_at": time.Now(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		err := errors.Wrap(ErrLockLost, l.Name)
+		l.finish(err)
+		return err
+	}
+	l.finish(nil)
+	return nil
+}
+
+/*
+KeepAlive 后台每ttl/3续约一次,直到释放、ctx结束或租约丢失,参数说明:
+
+	1、续约出错时重试,到期前仍未成功视为丢失
+	2、onLost在租约丢失时调用一次,可为空
+*/
+func (l *Lease) KeepAlive(ctx context.Context, onLost func(lease *Lease, err error)) {
+	interval := l.ttl / 3
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-l.done:
+				return
+			case <-ticker.C:
+			}
+			renewCtx, cancel := context.WithDeadline(ctx, l.ExpiresAt())
+			err := l.Renew(renewCtx)
+			cancel()
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, ErrLockLost) && time.Now().Before(l.ExpiresAt()) {
+				l.locker.l.Warn("分布式锁续约失败,等待重试", zap.String("name", l.Name), zap.Error(err))
+				continue
+			}
+			if !errors.Is(err, ErrLockLost) {
+				err = errors.Wrapf(ErrLockLost, "%s: %v", l.Name, err)
+			}
+			//Renew返回ErrLockLost时已结束租约,此处只处理续约超时,已释放时不回调
+			l.finish(err)
+			if err = l.Err(); err != nil && onLost != nil {
+				onLost(l, err)
+			}
+			return
+		}
+	}()
+}
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/utils"
+)
+
+// LoggerConfig gorm日志配置
+type LoggerConfig struct {
+	Level                logger.LogLevel //日志等级,Silent|Error|Warn|Info,出错的SQL不受等级限制始终记录
+	SlowThreshold        time.Duration   //慢查询阈值,为0时不记录慢查询
+	ParameterizedQueries bool            //记录带占位符的SQL,不拼接参数,避免敏感数据写入日志
+	ContextKeys          []string        //从ctx中读取并记录的字段,如request_id,gin.Context可直接读取c.Set的值
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields 向ctx附加字段,通过该ctx执行的SQL日志均会记录
+func WithLogFields(ctx context.Context, fields ...zap.Field) context.Context {
+	if exist, ok := ctx.Value(logFieldsKey{}).([]zap.Field); ok {
+		fields = append(append([]zap.Field{}, exist...), fields...)
+	}
+	return context.WithValue(ctx, logFieldsKey{}, fields)
+}
+
+// zapLogger 实现gorm logger.Interface,日志统一写入zap
+type zapLogger struct {
+	l *zap.Logger
+	LoggerConfig
+}
+
+// NewLogger 创建基于zap的gorm日志
+func NewLogger(l *zap.Logger, config LoggerConfig) logger.Interface {
+	return &zapLogger{
+		l:            l.WithOptions(zap.WithCaller(false)),
+		LoggerConfig: config,
+	}
+}
+
+// ParseLogLevel 解析日志等级,silent|error|warn|info,为空时返回warn
+func ParseLogLevel(level string) (logger.LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "silent":
+		return logger.Silent, nil
+	case "error":
+		return logger.Error, nil
+	case "", "warn":
+		return logger.Warn, nil
+	case "info":
+		return logger.Info, nil
+	default:
+		return logger.Warn, errors.Errorf("unsupported log level:%s", level)
+	}
+}
+
+func (z *zapLogger) LogMode(level logger.LogLevel) logger.Interface {
+	n := *z
+	n.Level = level
+	return &n
+}
+
+func (z *zapLogger) Info(ctx context.Context, msg string, data ...interface{}) {
+	if z.Level >= logger.Info {
+		z.l.Info(fmt.Sprintf(msg, data...), z.fields(ctx)...)
+	}
+}
+
+func (z *zapLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
+	if z.Level >= logger.Warn {
+		z.l.Warn(fmt.Sprintf(msg, data...), z.fields(ctx)...)
+	}
+}
+
+func (z *zapLogger) Error(ctx context.Context, msg string, data ...interface{}) {
+	if z.Level >= logger.Error {
+		z.l.Error(fmt.Sprintf(msg, data...), z.fields(ctx)...)
+	}
+}
+
+func (z *zapLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && IsTimeout(err):
+		sql, rows := fc()
+		fields := append(z.fields(ctx), zap.Error(err), zap.String("error_sql", sql), zap.Duration("elapsed", elapsed), rowsField(rows), zap.String("sql_caller", utils.FileWithLineNum()))
+		if ctx != nil {
+			if deadline, ok := ctx.Deadline(); ok {
+				fields = append(fields, zap.Duration("budget", deadline.Sub(begin)))
+			}
+		}
+		z.l.Error("Sql执行超时", fields...)
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound):
+		sql, rows := fc()
+		z.l.Error("Sql执行出错", append(z.fields(ctx), zap.Error(err), zap.String("error_sql", sql), zap.Duration("elapsed", elapsed), rowsField(rows), zap.String("sql_caller", utils.FileWithLineNum()))...)
+	case z.SlowThreshold != 0 && elapsed > z.SlowThreshold && z.Level >= logger.Warn:
+		sql, rows := fc()
+		z.l.Warn("慢查询", append(z.fields(ctx), zap.String("sql", sql), zap.Duration("elapsed", elapsed), zap.Duration("threshold", z.SlowThreshold), rowsField(rows), zap.String("sql_caller", utils.FileWithLineNum()))...)
+	case z.Level >= logger.Info:
+		sql, rows := fc()
+		z.l.Info("Sql执行", append(z.fields(ctx), zap.String("sql", sql), zap.Duration("elapsed", elapsed), rowsField(rows), zap.String("sql_caller", utils.FileWithLineNum()))...)
+	}
+}
+
+// ParamsFilter 实现gorm.ParamsFilter,开启ParameterizedQueries时不拼接参数
+func (z *zapLogger) ParamsFilter(_ context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	if z.ParameterizedQueries {
+		return sql, nil
+	}
+	return sql, params
+}
+
+func (z *zapLogger) fields(ctx context.Context) (fields []zap.Field) {
+	if ctx == nil {
+		return
+	}
+	if exist, ok := ctx.Value(logFieldsKey{}).([]zap.Field); ok {
+		fields = append(fields, exist...)
+	}
+	for _, key := range z.ContextKeys {
+		if v := ctx.Value(key); v != nil {
+			fields = append(fields, zap.Any(key, v))
+		}
+	}
+	return
+}
+
+func rowsField(rows int64) zap.Field {
+	if rows == -1 {
+		return zap.Skip()
+	}
+	return zap.Int64("rows", rows)
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Manager 按名称管理多个数据库连接,每个连接使用独立的连接池及日志
+type Manager struct {
+	l       *zap.Logger
+	entries map[string]*managedDB
+}
+
+type managedDB struct {
+	sync.Mutex
+	config Database
+	db     *gorm.DB
+	closed bool
+}
+
+/*
+NewManager 创建多数据库管理器,参数说明:
+
+	1、ctx用于立即创建连接时的重试等待,结束时停止创建
+	2、日志,每个连接的日志附带database字段
+	3、数据库配置,名称->配置,通常来自yaml
+	4、是否延迟连接,为true时首次Get时才创建连接,否则立即创建全部连接,任一失败则关闭已创建的连接并返回错误
+*/
+func NewManager(ctx context.Context, l *zap.Logger, configs map[string]Database, lazy bool) (m *Manager, err error) {
+	m = &Manager{
+		l:       l,
+		entries: make(map[string]*managedDB, len(configs)),
+	}
+	for name, config := range configs {
+		m.entries[name] = &managedDB{config: config}
+	}
+	if lazy {
+		return
+	}
+	for _, name := range m.Names() {
+		if _, err = m.Get(ctx, name); err != nil {
+			_ = m.Close()
+			return nil, err
+		}
+	}
+	return
+}
+
+// Names 已配置的数据库名称
+func (m *Manager) Names() (names []string) {
+	for name := range m.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Get 获取连接,延迟连接时首次调用创建,创建失败下次调用重试
+func (m *Manager) Get(ctx context.Context, name string) (*gorm.DB, error) {
+	entry, ok := m.entries[name]
+	if !ok {
+		return nil, errors.Errorf("database %s not configured", name)
+	}
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.closed {
+		return nil, errors.Errorf("database %s closed", name)
+	}
+	if entry.db == nil {
+		config := entry.config
+		if config.Name == "" {
+			config.Name = name
+		}
+		db, err := SetupDatabase(ctx, m.l.With(zap.String("database", name)), config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "setup database %s", name)
+		}
+		entry.db = db
+	}
+	return entry.db, nil
+}
+
+// Ping 检查已创建的连接,返回名称->错误,未创建的延迟连接不检查
+func (m *Manager) Ping(ctx context.Context) map[string]error {
+	result := make(map[string]error, len(m.entries))
+	for name, entry := range m.entries {
+		entry.Lock()
+		db := entry.db
+		entry.Unlock()
+		if db == nil {
+			continue
+		}
+		sqldb, err := db.DB()
+		if err == nil {
+			err = sqldb.PingContext(ctx)
+		}
+		result[name] = err
+	}
+	return result
+}
+
+// Close 关闭全部连接,返回遇到的第一个错误
+func (m *Manager) Close() (err error) {
+	for name, entry := range m.entries {
+		entry.Lock()
+		if entry.db != nil {
+			if e := CloseDatabase(entry.db); e != nil {
+				m.l.Error("关闭数据库连接失败", zap.String("database", name), zap.Error(e))
+				if err == nil {
+					err = e
+				}
+			}
+			entry.db = nil
+		}
+		entry.closed = true
+		entry.Unlock()
+	}
+	return
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"gorm.io/gorm"
+)
+
+const (
+	metricsPluginName = "database:metrics"
+	metricsBeginKey   = "database:metrics_begin"
+)
+
+// metrics 按表及操作统计语句次数及耗时,同一Registerer下的多个连接以db标签区分
+type metrics struct {
+	name     string
+	total    *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+/*
+UseMetrics 注册Prometheus指标,参数说明:
+
+	1、name连接名称,作为db标签
+	2、registerer为空时使用prometheus.DefaultRegisterer
+	3、指标:db_queries_total{db,table,operation,status},status为ok|error|timeout、db_query_duration_seconds{db,table,operation}及go_sql_*连接池指标
+*/
+func UseMetrics(db *gorm.DB, name string, registerer prometheus.Registerer) (err error) {
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+	m := &metrics{name: name}
+	var collector prometheus.Collector
+	if collector, err = register(registerer, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_queries_total",
+		Help: "Total number of executed statements by table, operation and status.",
+	}, []string{"db", "table", "operation", "status"})); err != nil {
+		return
+	}
+	m.total = collector.(*prometheus.CounterVec)
+	if collector, err = register(registerer, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Statement execution duration in seconds by table and operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"db", "table", "operation"})); err != nil {
+		return
+	}
+	m.duration = collector.(*prometheus.HistogramVec)
+	sqldb, err := db.DB()
+	if err != nil {
+		return
+	}
+	if err = replace(registerer, collectors.NewDBStatsCollector(sqldb, name)); err != nil {
+		return
+	}
+	return db.Use(m)
+}
+
+// register 注册指标,已注册时返回已有的指标,用于按db标签区分的计数及耗时指标
+func register(registerer prometheus.Registerer, collector prometheus.Collector) (prometheus.Collector, error) {
+	if err := registerer.Register(collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			return registered.ExistingCollector, nil
+		}
+		return nil, err
+	}
+	return collector, nil
+}
+
+// replace 注册指标,已注册时替换已有的指标,重连或重新初始化后连接池指标读取新的*sql.DB
+func replace(registerer prometheus.Registerer, collector prometheus.Collector) error {
+	err := registerer.Register(collector)
+	var registered prometheus.AlreadyRegisteredError
+	if !errors.As(err, &registered) {
+		return err
+	}
+	registerer.Unregister(registered.ExistingCollector)
+	return registerer.Register(collector)
+}
+
+func (m *metrics) Name() string {
+	return metricsPluginName
+}
+
+func (m *metrics) Initialize(db *gorm.DB) (err error) {
+	cb := db.Callback()
+	for _, register := range []func() error{
+		func() error { return cb.Create().Before("*").Register(metricsBeginKey, m.begin) },
+		func() error { return cb.Create().After("*").Register("database:metrics_end", m.end("create")) },
+		func() error { return cb.Query().Before("*").Register(metricsBeginKey, m.begin) },
+		func() error { return cb.Query().After("*").Register("database:metrics_end", m.end("query")) },
+		func() error { return cb.Update().Before("*").Register(metricsBeginKey, m.begin) },
+		func() error { return cb.Update().After("*").Register("database:metrics_end", m.end("update")) },
+		func() error { return cb.Delete().Before("*").Register(metricsBeginKey, m.begin) },
+		func() error { return cb.Delete().After("*").Register("database:metrics_end", m.end("delete")) },
+		func() error { return cb.Row().Before("*").Register(metricsBeginKey, m.begin) },
+		func() error { return cb.Row().After("*").Register("database:metrics_end", m.end("row")) },
+		func() error { return cb.Raw().Before("*").Register(metricsBeginKey, m.begin) },
+		func() error { return cb.Raw().After("*").Register("database:metrics_end", m.end("raw")) },
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (m *metrics) begin(db *gorm.DB) {
+	db.Statement.Settings.Store(metricsBeginKey, time.Now())
+}
+
+func (m *metrics) end(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		v, ok := db.Statement.Settings.LoadAndDelete(metricsBeginKey)
+		if !ok || db.DryRun {
+			return
+		}
+		status := "ok"
+		if IsTimeout(db.Error) {
+			status = "timeout"
+		} else if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			status = "error"
+		}
+		m.total.WithLabelValues(m.name, db.Statement.Table, operation, status).Inc()
+		m.duration.WithLabelValues(m.name, db.Statement.Table, operation).Observe(time.Since(v.(time.Time)).Seconds())
+	}
+}
@@ -0,0 +1,538 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var migrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Migration 一个版本的迁移,SQL迁移使用UpSQL/DownSQL,Go迁移使用Up/Down
+type Migration struct {
+	Version  int64
+	Name     string
+	UpSQL    string
+	DownSQL  string
+	Up       func(tx *gorm.DB) error
+	Down     func(tx *gorm.DB) error
+	Checksum string
+}
+
+// MigrationRecord 迁移历史表记录
+type MigrationRecord struct {
+	Version     int64     `gorm:"primaryKey;autoIncrement:false"`
+	Name        string    `gorm:"size:255"`
+	Checksum    string    `gorm:"size:64"`
+	AppliedAt   time.Time `gorm:"not null"`
+	ExecutionMs int64
+}
+
+// MigrationStatus 迁移状态
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool //已执行的迁移文件被修改
+	Missing   bool //已执行的迁移在本地不存在
+}
+
+type migrationLock struct {
+	ID       int       `gorm:"primaryKey;autoIncrement:false"`
+	Owner    string    `gorm:"size:255"`
+	LockedAt time.Time `gorm:"not null"`
+}
+
+type Migrator struct {
+	Table      string        //迁移历史表,默认schema_migrations
+	LockTable  string        //迁移锁表,默认schema_migrations_lock
+	LockWait   time.Duration //等待锁的最长时间,默认1分钟
+	LockExpire time.Duration //锁超过该时间未续期视为持有者已异常退出,默认10分钟,持有期间每LockExpire/3续期
+	db         *gorm.DB
+	l          *zap.Logger
+	mu         sync.Mutex
+	migrations map[int64]*Migration
+	lockOwner  string
+	lockPoll   time.Duration
+}
+
+func NewMigrator(l *zap.Logger, db *gorm.DB) *Migrator {
+	host, _ := os.Hostname()
+	return &Migrator{
+		Table:      "schema_migrations",
+		LockTable:  "schema_migrations_lock",
+		LockWait:   time.Minute,
+		LockExpire: 10 * time.Minute,
+		db:         db,
+		l:          l,
+		migrations: make(map[int64]*Migration),
+		lockOwner:  fmt.Sprintf("%s-%d-%d", host, os.Getpid(), time.Now().UnixNano()),
+		lockPoll:   time.Second,
+	}
+}
+
+// LoadFS 加载目录下的SQL迁移文件,文件名格式为 {版本号}_{名称}.up.sql / {版本号}_{名称}.down.sql,支持embed.FS及os.DirFS
+func (m *Migrator) LoadFS(fsys fs.FS, dir string) (err error) {
+	var entries []fs.DirEntry
+	if entries, err = fs.ReadDir(fsys, dir); err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		var (
+			version int64
+			body    []byte
+		)
+		if version, err = strconv.ParseInt(match[1], 10, 64); err != nil {
+			return
+		}
+		if body, err = fs.ReadFile(fsys, path.Join(dir, entry.Name())); err != nil {
+			return
+		}
+		migration, ok := m.migrations[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			m.migrations[version] = migration
+		}
+		if migration.Name != match[2] || migration.Up != nil {
+			return errors.Errorf("duplicate migration version %d", version)
+		}
+		if match[3] == "up" {
+			migration.UpSQL = string(body)
+		} else {
+			migration.DownSQL = string(body)
+		}
+		migration.Checksum = checksum(migration.UpSQL, migration.DownSQL)
+	}
+	return
+}
+
+/*
+Register 注册Go迁移,参数说明:
+
+	1、source为迁移实现的源码,校验和由版本号、名称及源码计算,修改实现后Validate可发现
+	2、通常将迁移放在单独的文件中并通过go:embed嵌入该文件作为source,为空时无法发现修改
+*/
+func (m *Migrator) Register(version int64, name, source string, up, down func(tx *gorm.DB) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.migrations[version]; ok {
+		return errors.Errorf("duplicate migration version %d", version)
+	}
+	m.migrations[version] = &Migration{
+		Version:  version,
+		Name:     name,
+		Up:       up,
+		Down:     down,
+		Checksum: checksum(strconv.FormatInt(version, 10), name, source),
+	}
+	return nil
+}
+
+// Migrations 按版本号升序返回已加载的迁移
+func (m *Migrator) Migrations() []*Migration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	migrations := make([]*Migration, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations
+}
+
+// Up 执行所有未执行的迁移
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, -1)
+}
+
+// Down 回滚最近执行的steps个迁移
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(db *gorm.DB) (err error) {
+		var records []MigrationRecord
+		if records, err = m.applied(db); err != nil {
+			return
+		}
+		for i := len(records) - 1; i >= 0 && steps > 0; i, steps = i-1, steps-1 {
+			if err = m.revert(db, records[i]); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// To 迁移到指定版本,大于当前版本则执行,小于则回滚,version为-1时执行全部
+func (m *Migrator) To(ctx context.Context, version int64) error {
+	return m.withLock(ctx, func(db *gorm.DB) (err error) {
+		var records []MigrationRecord
+		if records, err = m.applied(db); err != nil {
+			return
+		}
+		applied := make(map[int64]bool, len(records))
+		for _, record := range records {
+			applied[record.Version] = true
+		}
+		for i := len(records) - 1; i >= 0 && version >= 0; i-- {
+			if records[i].Version <= version {
+				break
+			}
+			if err = m.revert(db, records[i]); err != nil {
+				return
+			}
+		}
+		for _, migration := range m.Migrations() {
+			if version >= 0 && migration.Version > version {
+				break
+			}
+			if applied[migration.Version] {
+				continue
+			}
+			if err = m.apply(db, migration); err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// Status 本地迁移与已执行迁移的对比
+func (m *Migrator) Status(ctx context.Context) (status []MigrationStatus, err error) {
+	db := m.db.WithContext(WithPrimary(ctx))
+	if err = m.ensureTables(db); err != nil {
+		return
+	}
+	var records []MigrationRecord
+	if records, err = m.applied(db); err != nil {
+		return
+	}
+	applied := make(map[int64]MigrationRecord, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	for _, migration := range m.Migrations() {
+		record, ok := applied[migration.Version]
+		status = append(status, MigrationStatus{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Applied:   ok,
+			AppliedAt: record.AppliedAt,
+			Modified:  ok && record.Checksum != migration.Checksum,
+		})
+		delete(applied, migration.Version)
+	}
+	for _, record := range applied {
+		status = append(status, MigrationStatus{
+			Version:   record.Version,
+			Name:      record.Name,
+			Applied:   true,
+			AppliedAt: record.AppliedAt,
+			Missing:   true,
+		})
+	}
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Version < status[j].Version
+	})
+	return
+}
+
+// Validate 校验已执行的迁移在本地存在且未被修改
+func (m *Migrator) Validate(ctx context.Context) (err error) {
+	var status []MigrationStatus
+	if status, err = m.Status(ctx); err != nil {
+		return
+	}
+	var problems []string
+	for _, s := range status {
+		switch {
+		case s.Missing:
+			problems = append(problems, fmt.Sprintf("%d_%s applied but missing", s.Version, s.Name))
+		case s.Modified:
+			problems = append(problems, fmt.Sprintf("%d_%s checksum mismatch", s.Version, s.Name))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("migration validate failed: %s", strings.Join(problems, "; "))
+	}
+	return
+}
+
+func (m *Migrator) apply(db *gorm.DB, migration *Migration) (err error) {
+	start := time.Now()
+	if err = db.Transaction(func(tx *gorm.DB) (e error) {
+		if migration.Up != nil {
+			e = migration.Up(tx)
+		} else {
+			e = execSQL(tx, migration.UpSQL)
+		}
+		if e != nil {
+			return
+		}
+		return tx.Table(m.Table).Create(&MigrationRecord{
+			Version:     migration.Version,
+			Name:        migration.Name,
+			Checksum:    migration.Checksum,
+			AppliedAt:   time.Now(),
+			ExecutionMs: time.Since(start).Milliseconds(),
+		}).Error
+	}); err != nil {
+		m.l.Error("执行迁移失败", zap.Int64("version", migration.Version), zap.String("name", migration.Name), zap.Error(err))
+		return errors.Wrapf(err, "migrate up %d_%s", migration.Version, migration.Name)
+	}
+	m.l.Info("执行迁移成功", zap.Int64("version", migration.Version), zap.String("name", migration.Name), zap.Duration("duration", time.Since(start)))
+	return
+}
+
+func (m *Migrator) revert(db *gorm.DB, record MigrationRecord) (err error) {
+	m.mu.Lock()
+	migration, ok := m.migrations[record.Version]
+	m.mu.Unlock()
+	if !ok {
+		return errors.Errorf("migration %d_%s not found", record.Version, record.Name)
+	}
+	if migration.Down == nil && strings.TrimSpace(migration.DownSQL) == "" {
+		return errors.Errorf("migration %d_%s is irreversible", record.Version, record.Name)
+	}
+	if err = db.Transaction(func(tx *gorm.DB) (e error) {
+		if migration.Down != nil {
+			e = migration.Down(tx)
+		} else {
+			e = execSQL(tx, migration.DownSQL)
+		}
+		if e != nil {
+			return
+		}
+		return tx.Table(m.Table).Where("version = ?", record.Version).Delete(&MigrationRecord{}).Error
+	}); err != nil {
+		m.l.Error("回滚迁移失败", zap.Int64("version", record.Version), zap.String("name", record.Name), zap.Error(err))
+		return errors.Wrapf(err, "migrate down %d_%s", record.Version, record.Name)
+	}
+	m.l.Info("回滚迁移成功", zap.Int64("version", record.Version), zap.String("name", record.Name))
+	return
+}
+
+func (m *Migrator) applied(db *gorm.DB) (records []MigrationRecord, err error) {
+	err = db.Table(m.Table).Order("version").Find(&records).Error
+	return
+}
+
+func (m *Migrator) ensureTables(db *gorm.DB) (err error) {
+	if err = db.Table(m.Table).AutoMigrate(&MigrationRecord{}); err != nil {
+		return
+	}
+	return db.Table(m.LockTable).AutoMigrate(&migrationLock{})
+}
+
+// withLock 获取迁移锁后执行fn,同一时间只有一个实例执行迁移
+func (m *Migrator) withLock(ctx context.Context, fn func(db *gorm.DB) error) (err error) {
+	db := m.db.WithContext(WithPrimary(ctx))
+	if err = m.ensureTables(db); err != nil {
+		return
+	}
+	deadline := time.Now().Add(m.LockWait)
+	for {
+		//清理异常退出实例遗留的锁
+		db.Table(m.LockTable).Where("id = ? AND locked_at < ?", 1, time.Now().Add(-m.LockExpire)).Delete(&migrationLock{})
+		result := db.Table(m.LockTable).Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&migrationLock{ID: 1, Owner: m.lockOwner, LockedAt: time.Now()})
+		if err = result.Error; err != nil {
+			return
+		}
+		if result.RowsAffected > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.New("acquire migration lock timeout")
+		}
+		m.l.Info("等待迁移锁", zap.String("owner", m.lockOwner))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.lockPoll):
+		}
+	}
+	defer func() {
+		if e := m.db.Table(m.LockTable).Where("id = ? AND owner = ?", 1, m.lockOwner).Delete(&migrationLock{}).Error; e != nil {
+			m.l.Error("释放迁移锁失败", zap.Error(e))
+		}
+	}()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go m.heartbeat(ctx, cancel)
+	return fn(db.WithContext(WithPrimary(ctx)))
+}
+
+// heartbeat 定时续期迁移锁,避免执行时间较长时被其他实例视为过期清理,锁已被清理时取消迁移
+func (m *Migrator) heartbeat(ctx context.Context, cancel context.CancelFunc) {
+	interval := m.LockExpire / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		renewCtx, renewCancel := context.WithTimeout(WithPrimary(ctx), interval)
+		result := m.db.WithContext(renewCtx).Table(m.LockTable).Where("id = ? AND owner = ?", 1, m.lockOwner).Update("locked_at", time.Now())
+		renewCancel()
+		switch {
+		case ctx.Err() != nil:
+			return
+		case result.Error != nil:
+			m.l.Warn("迁移锁续期失败,等待重试", zap.Error(result.Error))
+		case result.RowsAffected == 0:
+			m.l.Error("迁移锁已丢失,取消迁移", zap.String("owner", m.lockOwner))
+			cancel()
+			return
+		}
+	}
+}
+
+func execSQL(tx *gorm.DB, script string) error {
+	for _, statement := range SplitStatements(script) {
+		if err := tx.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+SplitStatements 按分号拆分SQL脚本,说明:
+
+	1、忽略引号、注释及postgres $$、$tag$包围的函数体中的分号
+	2、支持mysql客户端的DELIMITER命令,存储过程、触发器使用DELIMITER $$ ... END$$ DELIMITER ;
+	3、sqlite、sqlserver的触发器等BEGIN...END中包含分号的语句无法拆分,需使用Go迁移执行
+*/
+func SplitStatements(script string) (statements []string) {
+	var (
+		current   strings.Builder
+		quote     rune
+		delimiter = []rune(";")
+		runes     = []rune(script)
+	)
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0:
+			current.WriteRune(r)
+			if r == '\\' && quote != '`' && i+1 < len(runes) {
+				i++
+				current.WriteRune(runes[i])
+			} else if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+			current.WriteRune(r)
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			current.WriteRune('\n')
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			for i += 2; i < len(runes) && !(runes[i] == '*' && i+1 < len(runes) && runes[i+1] == '/'); i++ {
+			}
+			i++
+		case strings.TrimSpace(current.String()) == "" && hasPrefixFold(runes[i:], "DELIMITER") &&
+			i+9 < len(runes) && (runes[i+9] == ' ' || runes[i+9] == '\t'):
+			end := i
+			for end < len(runes) && runes[end] != '\n' {
+				end++
+			}
+			if fields := strings.Fields(string(runes[i+9 : end])); len(fields) > 0 {
+				delimiter = []rune(fields[0])
+			}
+			current.Reset()
+			i = end
+		case hasPrefix(runes[i:], delimiter):
+			flush()
+			i += len(delimiter) - 1
+		case r == '$' && dollarTag(runes[i:]) != nil:
+			tag := dollarTag(runes[i:])
+			end := i + len(tag)
+			for end < len(runes) && !hasPrefix(runes[end:], tag) {
+				end++
+			}
+			if end += len(tag); end > len(runes) {
+				end = len(runes)
+			}
+			current.WriteString(string(runes[i:end]))
+			i = end - 1
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return
+}
+
+// dollarTag postgres的$$或$tag$,不是时返回nil
+func dollarTag(runes []rune) []rune {
+	for i := 1; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '$':
+			return runes[:i+1]
+		case r == '_' || unicode.IsLetter(r) || (i > 1 && unicode.IsDigit(r)):
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func hasPrefix(runes, prefix []rune) bool {
+	if len(runes) < len(prefix) {
+		return false
+	}
+	for i, r := range prefix {
+		if runes[i] != r {
+			return false
+		}
+	}
+	return true
+}
+
+func hasPrefixFold(runes []rune, prefix string) bool {
+	return len(runes) >= len(prefix) && strings.EqualFold(string(runes[:len(prefix)]), prefix)
+}
+
+func checksum(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	versionPluginName = "database:version"
+	versionStateKey   = "database:version_state"
+)
+
+// ErrVersionConflict 乐观锁版本不一致,数据已被修改或删除
+var ErrVersionConflict = errors.New("version conflict")
+
+// Version 乐观锁版本号,模型包含该类型的字段时,更新按版本号校验并自增
+type Version int64
+
+// Model 可嵌入的基础模型,包含主键、创建及更新时间、软删除及乐观锁版本号
+type Model struct {
+	ID        uint64         `gorm:"primaryKey;autoIncrement" json:"id"` //主键
+	CreatedAt time.Time      `json:"created_at"`                         //创建时间
+	UpdatedAt time.Time      `json:"updated_at"`                         //更新时间
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`                     //删除时间,删除时为软删除
+	Version   Version        `gorm:"not null" json:"version"`            //版本号,创建时为1,每次更新加1
+}
+
+// ConflictError 按版本号更新时没有匹配的数据
+type ConflictError struct {
+	Table      string      //表名
+	PrimaryKey interface{} //主键
+	Version    Version     //更新时的版本号
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("version conflict: table %s, primary key %v, version %d", e.Table, e.PrimaryKey, e.Version)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+// versionState 按版本号校验的更新
+type versionState struct {
+	field   *schema.Field
+	current Version
+	value   reflect.Value
+}
+
+// optimisticLock 乐观锁插件
+type optimisticLock struct{}
+
+/*
+UseOptimisticLock 注册乐观锁插件,说明:
+
+	1、创建时版本号为0则设置为1
+	2、更新单条数据且版本号不为0时,按版本号追加条件并加1,没有匹配的数据时返回*ConflictError
+	3、批量更新及版本号为0时只将版本号加1,不校验
+*/
+func UseOptimisticLock(db *gorm.DB) error {
+	return db.Use(&optimisticLock{})
+}
+
+func (o *optimisticLock) Name() string {
+	return versionPluginName
+}
+
+func (o *optimisticLock) Initialize(db *gorm.DB) (err error) {
+	cb := db.Callback()
+	for _, register := range []func() error{
+		func() error { return cb.Create().Before("gorm:create").Register(versionPluginName, o.create) },
+		func() error { return cb.Update().Before("gorm:update").Register(versionPluginName, o.before) },
+		func() error { return cb.Update().After("gorm:update").Register("database:version_check", o.after) },
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func versionField(s *schema.Schema) *schema.Field {
+	if s == nil {
+		return nil
+	}
+	for _, field := range s.Fields {
+		if field.DBName != "" && field.FieldType == reflect.TypeOf(Version(0)) {
+			return field
+		}
+	}
+	return nil
+}
+
+func (o *optimisticLock) create(db *gorm.DB) {
+	field := versionField(db.Statement.Schema)
+	if db.Error != nil || field == nil {
+		return
+	}
+	stmt := db.Statement
+	assign := func(rv reflect.Value) {
+		if _, zero := field.ValueOf(stmt.Context, rv); zero {
+			_ = db.AddError(field.Set(stmt.Context, rv, Version(1)))
+		}
+	}
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Struct:
+		assign(stmt.ReflectValue)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < stmt.ReflectValue.Len(); i++ {
+			assign(reflect.Indirect(stmt.ReflectValue.Index(i)))
+		}
+	}
+}
+
+// before 生成SET子句并替换版本号列,gorm:update使用已有的SET子句
+func (o *optimisticLock) before(db *gorm.DB) {
+	stmt := db.Statement
+	field := versionField(stmt.Schema)
+	if db.Error != nil || field == nil || stmt.SQL.Len() > 0 {
+		return
+	}
+	if _, ok := stmt.Clauses["SET"]; ok {
+		return
+	}
+	set := callbacks.ConvertToAssignments(stmt)
+	if len(set) == 0 {
+		return
+	}
+	assignments := make(clause.Set, 0, len(set)+1)
+	for _, assignment := range set {
+		if assignment.Column.Name != field.DBName {
+			assignments = append(assignments, assignment)
+		}
+	}
+	state := versionState{field: field}
+	if stmt.ReflectValue.Kind() == reflect.Struct {
+		if value, zero := field.ValueOf(stmt.Context, stmt.ReflectValue); !zero {
+			state.current, state.value = value.(Version), stmt.ReflectValue
+		}
+	}
+	if state.current != 0 {
+		assignments = append(assignments, clause.Assignment{Column: clause.Column{Name: field.DBName}, Value: state.current + 1})
+		stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+			clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: state.current},
+		}})
+	} else {
+		assignments = append(assignments, clause.Assignment{Column: clause.Column{Name: field.DBName}, Value: gorm.Expr("? + 1", clause.Column{Name: field.DBName})})
+	}
+	stmt.AddClause(assignments)
+	stmt.Settings.Store(versionStateKey, state)
+}
+
+// after 校验影响行数,成功时同步模型的版本号,失败时错误阻止Save转为插入
+func (o *optimisticLock) after(db *gorm.DB) {
+	v, ok := db.Statement.Settings.LoadAndDelete(versionStateKey)
+	if !ok {
+		return
+	}
+	delete(db.Statement.Clauses, "SET")
+	state := v.(versionState)
+	if db.Error != nil || db.DryRun || state.current == 0 {
+		return
+	}
+	if db.RowsAffected == 0 {
+		var primaryKey interface{}
+		if field := db.Statement.Schema.PrioritizedPrimaryField; field != nil {
+			primaryKey, _ = field.ValueOf(db.Statement.Context, state.value)
+		}
+		_ = db.AddError(&ConflictError{Table: db.Statement.Table, PrimaryKey: primaryKey, Version: state.current})
+		return
+	}
+	_ = db.AddError(state.field.Set(db.Statement.Context, state.value, state.current+1))
+}
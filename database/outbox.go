@@ -0,0 +1,318 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	OutboxPending = 0 //待发送
+	OutboxSent    = 1 //已发送
+	OutboxDead    = 2 //超过最大重试次数,不再发送,同一聚合键的后续消息等待Retry后继续
+)
+
+// OutboxMessage 发件箱消息,与业务数据在同一事务中写入,由Outbox.Run发布
+type OutboxMessage struct {
+	ID           uint64     `gorm:"primaryKey;autoIncrement" json:"id"`                //消费者可用于幂等去重
+	AggregateKey string     `gorm:"size:128;index" json:"aggregate_key"`               //聚合键,同一键的消息按写入顺序发布,为空时不保证顺序
+	Topic        string     `gorm:"size:128" json:"topic"`                             //发布目标,如交换机名称
+	RoutingKey   string     `gorm:"size:128" json:"routing_key"`                       //路由键
+	Payload      []byte     `json:"payload"`                                           //消息内容
+	Status       int8       `gorm:"index:idx_outbox_status,priority:1" json:"status"`  //状态
+	Attempts     int        `json:"attempts"`                                          //已发送次数
+	LastError    string     `gorm:"size:1024" json:"last_error"`                       //最近一次发送错误
+	NextAt       time.Time  `gorm:"index:idx_outbox_status,priority:2" json:"next_at"` //下次发送时间
+	CreatedAt    time.Time  `json:"created_at"`                                        //写入时间
+	SentAt       *time.Time `json:"sent_at"`                                           //发送成功时间
+}
+
+// Publisher 消息发布
+type Publisher interface {
+	Publish(ctx context.Context, msg *OutboxMessage) error
+}
+
+// PublisherFunc 函数适配Publisher
+type PublisherFunc func(ctx context.Context, msg *OutboxMessage) error
+
+func (f PublisherFunc) Publish(ctx context.Context, msg *OutboxMessage) error {
+	return f(ctx, msg)
+}
+
+// MessagePublisher 按目标及路由键发布消息,amqp.OutboxPublisher实现该接口
+type MessagePublisher interface {
+	PublishMessage(ctx context.Context, topic, routingKey, messageID string, body []byte) error
+}
+
+/*
+NewMessagePublisher MessagePublisher适配为Publisher,消息ID为发件箱ID,供消费者幂等处理,如发布到amqp:
+
+	outbox := database.NewOutbox(l, db, database.NewMessagePublisher(amqp.NewOutboxPublisher(client)))
+*/
+func NewMessagePublisher(p MessagePublisher) Publisher {
+	return PublisherFunc(func(ctx context.Context, msg *OutboxMessage) error {
+		return p.PublishMessage(ctx, msg.Topic, msg.RoutingKey, strconv.FormatUint(msg.ID, 10), msg.Payload)
+	})
+}
+
+// MemoryPublisher 内存发布,用于测试,Fail不为空时返回的错误作为发布结果
+type MemoryPublisher struct {
+	sync.Mutex
+	Fail     func(msg *OutboxMessage) error
+	messages []OutboxMessage
+}
+
+func (p *MemoryPublisher) Publish(_ context.Context, msg *OutboxMessage) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.Fail != nil {
+		if err := p.Fail(msg); err != nil {
+			return err
+		}
+	}
+	p.messages = append(p.messages, *msg)
+	return nil
+}
+
+// Messages 已发布的消息
+func (p *MemoryPublisher) Messages() []OutboxMessage {
+	p.Lock()
+	defer p.Unlock()
+	return append([]OutboxMessage{}, p.messages...)
+}
+
+// Outbox 事务发件箱,多实例同时运行Run时消息可能重复发布,消费者需按ID幂等处理
+type Outbox struct {
+	Table           string        //表名,默认outbox_message
+	BatchSize       int           //每批发布数量,默认100
+	Interval        time.Duration //轮询间隔,默认1秒,事务提交后立即唤醒
+	MaxAttempts     int           //最大发送次数,默认10,超过后标记为不再发送
+	Backoff         time.Duration //首次重试等待时间,之后每次翻倍,默认1秒
+	MaxBackoff      time.Duration //最大重试等待时间,默认5分钟
+	Retention       time.Duration //已发送消息保留时长,默认7天
+	CleanupInterval time.Duration //清理间隔,默认1小时
+	l               *zap.Logger
+	db              *gorm.DB
+	publisher       Publisher
+	wake            chan struct{}
+}
+
+// NewOutbox 创建发件箱,publisher为空时只能写入
+func NewOutbox(l *zap.Logger, db *gorm.DB, publisher Publisher) *Outbox {
+	return &Outbox{
+		Table:           "outbox_message",
+		BatchSize:       100,
+		Interval:        time.Second,
+		MaxAttempts:     10,
+		Backoff:         time.Second,
+		MaxBackoff:      5 * time.Minute,
+		Retention:       7 * 24 * time.Hour,
+		CleanupInterval: time.Hour,
+		l:               l,
+		db:              db,
+		publisher:       publisher,
+		wake:            make(chan struct{}, 1),
+	}
+}
+
+// Migrate 创建发件箱表
+func (o *Outbox) Migrate() error {
+	return migrator(o.db).Table(o.Table).AutoMigrate(&OutboxMessage{})
+}
+
+// Enqueue 写入消息,ctx中有WithTx开启的事务时加入该事务,提交后唤醒发布
+func (o *Outbox) Enqueue(ctx context.Context, msgs ...*OutboxMessage) (err error) {
+	if err = o.create(DBFromContext(ctx, o.db), msgs); err != nil {
+		return
+	}
+	AfterCommit(ctx, func(context.Context) {
+		o.Notify()
+	})
+	return
+}
+
+/*
+EnqueueTx 在tx中写入消息,用于db.Transaction开启的事务:
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+		return outbox.EnqueueTx(tx, &database.OutboxMessage{Topic: "order", Payload: payload})
+	})
+
+无法感知提交,提交后由轮询发布,需要立即发布时在Transaction返回后调用Notify
+*/
+func (o *Outbox) EnqueueTx(tx *gorm.DB, msgs ...*OutboxMessage) error {
+	return o.create(tx.Session(&gorm.Session{NewDB: true}), msgs)
+}
+
+func (o *Outbox) create(db *gorm.DB, msgs []*OutboxMessage) error {
+	if len(msgs) <= 0 {
+		return nil
+	}
+	now := time.Now()
+	for _, msg := range msgs {
+		msg.Status = OutboxPending
+		msg.NextAt = now
+	}
+	return db.Table(o.Table).Create(msgs).Error
+}
+
+// Notify 唤醒发布
+func (o *Outbox) Notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run 循环发布及清理,直到ctx结束
+func (o *Outbox) Run(ctx context.Context) error {
+	if o.publisher == nil {
+		return errors.New("outbox publisher is nil")
+	}
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+	var lastCleanup time.Time
+	for {
+		o.safe(func() {
+			for {
+				sent, err := o.Relay(ctx)
+				if err != nil {
+					o.l.Error("发件箱发布失败", zap.Error(err))
+					return
+				}
+				//未满一批说明暂无更多待发送消息
+				if sent < o.BatchSize {
+					return
+				}
+			}
+		})
+		if time.Since(lastCleanup) >= o.CleanupInterval {
+			lastCleanup = time.Now()
+			o.safe(func() {
+				if _, err := o.Cleanup(ctx); err != nil {
+					o.l.Error("发件箱清理失败", zap.Error(err))
+				}
+			})
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+func (o *Outbox) safe(fn func()) {
+	defer func() {
+		if e := recover(); e != nil {
+			o.l.Error("发件箱异常", zap.Any("error", e))
+		}
+	}()
+	fn()
+}
+
+// Relay 发布一批到期的待发送消息,返回处理的消息数量,同一聚合键存在更早的未到期或不再发送的消息时不查询
+func (o *Outbox) Relay(ctx context.Context) (processed int, err error) {
+	if o.publisher == nil {
+		return 0, errors.New("outbox publisher is nil")
+	}
+	db := o.db.WithContext(WithPrimary(ctx))
+	now := time.Now()
+	//被阻塞的消息不占用批次,避免其他聚合键的消息无法发布
+	table := db.Statement.Quote(o.Table)
+	var msgs []*OutboxMessage
+	if err = db.Table(o.Table).Where("status = ? AND next_at <= ?", OutboxPending, now).
+		Where(fmt.Sprintf("aggregate_key = '' OR NOT EXISTS (SELECT 1 FROM %s AS e WHERE e.aggregate_key = %s.aggregate_key AND e.id < %s.id AND (e.status = ? OR (e.status = ? AND e.next_at > ?)))", table, table, table),
+			OutboxDead, OutboxPending, now).
+		Order("id").Limit(o.BatchSize).Find(&msgs).Error; err != nil {
+		return
+	}
+	//本批中发送失败的聚合键,其后的消息等待下次发布
+	blocked := make(map[string]bool)
+	for _, msg := range msgs {
+		if ctx.Err() != nil {
+			return processed, ctx.Err()
+		}
+		if msg.AggregateKey != "" && blocked[msg.AggregateKey] {
+			continue
+		}
+		processed++
+		if e := o.publisher.Publish(ctx, msg); e != nil {
+			if err = o.fail(db, msg, e); err != nil {
+				return
+			}
+			blocked[msg.AggregateKey] = true
+			continue
+		}
+		sentAt := time.Now()
+		if err = db.Table(o.Table).Where("id = ?", msg.ID).Updates(map[string]interface{}{
+			"status":   OutboxSent,
+			"attempts": msg.Attempts + 1,
+			"sent_at":  sentAt,
+		}).Error; err != nil {
+			return
+		}
+	}
+	return
+}
+
+// fail 记录发送失败,按次数退避,超过最大次数标记为不再发送
+func (o *Outbox) fail(db *gorm.DB, msg *OutboxMessage, cause error) error {
+	msg.Attempts++
+	backoff := o.Backoff
+	for i := 1; i < msg.Attempts && backoff < o.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > o.MaxBackoff {
+		backoff = o.MaxBackoff
+	}
+	msg.NextAt = time.Now().Add(backoff)
+	if o.MaxAttempts > 0 && msg.Attempts >= o.MaxAttempts {
+		msg.Status = OutboxDead
+		o.l.Error("发件箱消息超过最大发送次数", zap.Uint64("id", msg.ID), zap.String("aggregate_key", msg.AggregateKey), zap.Error(cause))
+	} else {
+		o.l.Warn("发件箱消息发送失败", zap.Uint64("id", msg.ID), zap.Int("attempts", msg.Attempts), zap.Duration("backoff", backoff), zap.Error(cause))
+	}
+	lastError := cause.Error()
+	if len(lastError) > 1024 {
+		lastError = lastError[:1024]
+	}
+	return db.Table(o.Table).Where("id = ?", msg.ID).Updates(map[string]interface{}{
+		"status":     msg.Status,
+		"attempts":   msg.Attempts,
+		"last_error": lastError,
+		"next_at":    msg.NextAt,
+	}).Error
+}
+
+// Cleanup 删除超过保留时长的已发送消息
+func (o *Outbox) Cleanup(ctx context.Context) (int64, error) {
+	result := o.db.WithContext(ctx).Table(o.Table).
+		Where("status = ? AND sent_at < ?", OutboxSent, time.Now().Add(-o.Retention)).
+		Delete(&OutboxMessage{})
+	return result.RowsAffected, result.Error
+}
+
+// Retry 将不再发送的消息重置为待发送,ids为空时重置全部
+func (o *Outbox) Retry(ctx context.Context, ids ...uint64) (int64, error) {
+	tx := o.db.WithContext(ctx).Table(o.Table).Where("status = ?", OutboxDead)
+	if len(ids) > 0 {
+		tx = tx.Where("id IN ?", ids)
+	}
+	result := tx.Updates(map[string]interface{}{
+		"status":   OutboxPending,
+		"attempts": 0,
+		"next_at":  time.Now(),
+	})
+	return result.RowsAffected, result.Error
+}
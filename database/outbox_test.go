@@ -0,0 +1,175 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestOutbox(t *testing.T, publisher Publisher) (*gorm.DB, *Outbox) {
+	t.Helper()
+	db, err := gorm.Open(drivers["sqlite"].dialector(filepath.Join(t.TempDir(), "outbox.db"), Database{}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = CloseDatabase(db)
+	})
+	o := NewOutbox(zap.NewNop(), db, publisher)
+	o.Backoff, o.MaxBackoff = time.Hour, time.Hour
+	if err = o.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return db, o
+}
+
+func payloads(msgs []OutboxMessage) (result []string) {
+	for _, msg := range msgs {
+		result = append(result, string(msg.Payload))
+	}
+	return
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestOutboxEnqueueTx(t *testing.T) {
+	publisher := &MemoryPublisher{}
+	db, o := newTestOutbox(t, publisher)
+	ctx := context.Background()
+
+	//回滚的事务不写入消息
+	_ = db.Transaction(func(tx *gorm.DB) error {
+		if err := o.EnqueueTx(tx, &OutboxMessage{Topic: "order", Payload: []byte("rollback")}); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("rollback")
+	})
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return o.EnqueueTx(tx, &OutboxMessage{Topic: "order", Payload: []byte("commit")})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithTx(ctx, db, nil, func(ctx context.Context, tx *gorm.DB) error {
+		return o.Enqueue(ctx, &OutboxMessage{Topic: "order", Payload: []byte("with_tx")})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(publisher.Messages()); !equalStrings(got, []string{"commit", "with_tx"}) {
+		t.Fatalf("published %v", got)
+	}
+}
+
+func TestOutboxRelayOrdering(t *testing.T) {
+	failing := map[string]bool{"a1": true}
+	publisher := &MemoryPublisher{Fail: func(msg *OutboxMessage) error {
+		if failing[string(msg.Payload)] {
+			return errors.New("broker unavailable")
+		}
+		return nil
+	}}
+	db, o := newTestOutbox(t, publisher)
+	o.BatchSize = 3
+	ctx := context.Background()
+	msgs := []*OutboxMessage{
+		{AggregateKey: "a", Payload: []byte("a1")},
+		{AggregateKey: "a", Payload: []byte("a2")},
+		{AggregateKey: "a", Payload: []byte("a3")},
+		{AggregateKey: "a", Payload: []byte("a4")},
+		{AggregateKey: "b", Payload: []byte("b1")},
+		{Payload: []byte("c1")},
+	}
+	if err := o.Enqueue(ctx, msgs...); err != nil {
+		t.Fatal(err)
+	}
+
+	//a1失败后同一批中a的后续消息跳过
+	if _, err := o.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(publisher.Messages()); len(got) != 0 {
+		t.Fatalf("first batch published %v", got)
+	}
+	//a1等待重试期间a的消息不占用批次,其他聚合键继续发布
+	if _, err := o.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(publisher.Messages()); !equalStrings(got, []string{"b1", "c1"}) {
+		t.Fatalf("second batch published %v", got)
+	}
+
+	//超过最大次数的消息继续阻塞同一聚合键
+	o.MaxAttempts = 2
+	db.Table(o.Table).Where("id = ?", msgs[0].ID).Update("next_at", time.Now().Add(-time.Second))
+	if _, err := o.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var dead OutboxMessage
+	db.Table(o.Table).Where("id = ?", msgs[0].ID).Take(&dead)
+	if dead.Status != OutboxDead {
+		t.Fatalf("a1 status %d", dead.Status)
+	}
+	if _, err := o.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(publisher.Messages()); !equalStrings(got, []string{"b1", "c1"}) {
+		t.Fatalf("dead message unblocked %v", got)
+	}
+
+	//Retry后按顺序发布
+	delete(failing, "a1")
+	if _, err := o.Retry(ctx, msgs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := o.Relay(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := payloads(publisher.Messages()); !equalStrings(got, []string{"b1", "c1", "a1", "a2", "a3", "a4"}) {
+		t.Fatalf("published %v", got)
+	}
+}
+
+type messagePublisherFunc func(ctx context.Context, topic, routingKey, messageID string, body []byte) error
+
+func (f messagePublisherFunc) PublishMessage(ctx context.Context, topic, routingKey, messageID string, body []byte) error {
+	return f(ctx, topic, routingKey, messageID, body)
+}
+
+func TestOutboxMessagePublisher(t *testing.T) {
+	var got []string
+	_, o := newTestOutbox(t, NewMessagePublisher(messagePublisherFunc(func(_ context.Context, topic, routingKey, messageID string, body []byte) error {
+		got = append(got, topic, routingKey, messageID, string(body))
+		return nil
+	})))
+	ctx := context.Background()
+	msg := &OutboxMessage{Topic: "order", RoutingKey: "order.created", Payload: []byte("1")}
+	if err := o.Enqueue(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !equalStrings(got, []string{"order", "order.created", "1", "1"}) {
+		t.Fatalf("published %v", got)
+	}
+}
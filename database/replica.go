@@ -0,0 +1,294 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const (
+	PolicyRandom     = "random"      //随机
+	PolicyRoundRobin = "round_robin" //轮询
+	PolicyLeastConn  = "least_conn"  //使用中连接数最少
+
+	replicaPluginName = "database:replica"
+	primaryKey        = "database:primary"
+	replicaKey        = "database:replica"
+)
+
+type primaryCtxKey struct{}
+
+// WithPrimary 标记ctx内的查询强制使用主库,用于写后立即读
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryCtxKey{}, true)
+}
+
+// Primary 当前查询强制使用主库,Migrator内部语句不继承Set的设置,迁移需使用WithPrimary
+func Primary(db *gorm.DB) *gorm.DB {
+	return db.Set(primaryKey, true)
+}
+
+// migrator 迁移会话使用主库,表结构检查读副本时可能因复制延迟误判表或列不存在
+func migrator(db *gorm.DB) *gorm.DB {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return db.WithContext(WithPrimary(ctx))
+}
+
+type replica struct {
+	index   int
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// routed 路由到副本的语句,执行后恢复原连接,避免复用Statement的后续写入使用副本
+type routed struct {
+	replica *replica
+	pool    gorm.ConnPool
+}
+
+// replicaSet 读写分离插件,查询路由到健康的副本,写入、事务、加锁查询、迁移及强制主库的查询使用主库
+type replicaSet struct {
+	l        *zap.Logger
+	policy   string
+	interval time.Duration
+	replicas []*replica
+	counter  atomic.Uint64
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// useReplicas 打开副本连接并注册读写分离插件
+func useReplicas(l *zap.Logger, db *gorm.DB, drv Driver, inParams Database) (err error) {
+	rs := &replicaSet{
+		l:        l,
+		policy:   inParams.ReplicaPolicy,
+		interval: time.Duration(inParams.ReplicaCheck) * time.Second,
+		stop:     make(chan struct{}),
+	}
+	if rs.interval <= 0 {
+		rs.interval = 10 * time.Second
+	}
+	switch rs.policy {
+	case "":
+		rs.policy = PolicyRandom
+	case PolicyRandom, PolicyRoundRobin, PolicyLeastConn:
+	default:
+		return errors.Errorf("unsupported replica policy:%s", rs.policy)
+	}
+	for i, dsn := range inParams.Replicas {
+		var (
+			conn  *gorm.DB
+			sqldb *sql.DB
+		)
+		if conn, err = gorm.Open(drv.dialector(dsn, inParams), &gorm.Config{Logger: db.Logger}); err != nil {
+			rs.Close()
+			l.Error("创建副本连接失败", zap.Int("replica", i), zap.Error(err))
+			return
+		}
+		if drv.Init != nil {
+			if err = drv.Init(conn, inParams); err != nil {
+				rs.Close()
+				l.Error("副本初始化失败", zap.Int("replica", i), zap.Error(err))
+				return
+			}
+		}
+		if sqldb, err = conn.DB(); err != nil {
+			rs.Close()
+			return
+		}
+		sqldb.SetMaxIdleConns(inParams.MaxIdleConns)
+		sqldb.SetMaxOpenConns(inParams.MaxOpenConns)
+		sqldb.SetConnMaxLifetime(time.Second * time.Duration(inParams.MaxLifeTime))
+		r := &replica{index: i, db: sqldb}
+		//启动时不可用的副本先摘除,由健康检查恢复
+		if e := sqldb.Ping(); e != nil {
+			l.Warn("副本不可用,已摘除", zap.Int("replica", i), zap.Error(e))
+		} else {
+			r.healthy.Store(true)
+		}
+		rs.replicas = append(rs.replicas, r)
+	}
+	if err = db.Use(rs); err != nil {
+		rs.Close()
+		return
+	}
+	go rs.check()
+	return
+}
+
+func (rs *replicaSet) Name() string {
+	return replicaPluginName
+}
+
+func (rs *replicaSet) Initialize(db *gorm.DB) (err error) {
+	cb := db.Callback()
+	for _, register := range []func() error{
+		func() error { return cb.Query().Before("gorm:query").Register("database:replica", rs.route) },
+		func() error { return cb.Row().Before("gorm:row").Register("database:replica", rs.route) },
+		func() error { return cb.Query().After("gorm:query").Register("database:replica_eject", rs.eject) },
+		func() error { return cb.Row().After("gorm:row").Register("database:replica_eject", rs.eject) },
+		//写入及原生执行始终使用主库
+		func() error { return cb.Create().Before("*").Register("database:replica_primary", rs.restore) },
+		func() error { return cb.Update().Before("*").Register("database:replica_primary", rs.restore) },
+		func() error { return cb.Delete().Before("*").Register("database:replica_primary", rs.restore) },
+		func() error { return cb.Raw().Before("*").Register("database:replica_primary", rs.restore) },
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// route 选择副本,原生SQL仅SELECT且不加锁时使用副本
+func (rs *replicaSet) route(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	if _, ok := db.Statement.ConnPool.(gorm.TxCommitter); ok {
+		return
+	}
+	if _, ok := db.Statement.Settings.Load(primaryKey); ok {
+		return
+	}
+	if ctx := db.Statement.Context; ctx != nil && ctx.Value(primaryCtxKey{}) != nil {
+		return
+	}
+	if _, locking := db.Statement.Clauses["FOR"]; locking {
+		return
+	}
+	if rawSQL := strings.TrimSpace(db.Statement.SQL.String()); len(rawSQL) > 0 {
+		if len(rawSQL) < 6 || !strings.EqualFold(rawSQL[:6], "select") || strings.HasSuffix(strings.ToLower(rawSQL), "for update") {
+			return
+		}
+	}
+	if r := rs.pick(); r != nil {
+		db.Statement.Settings.Store(replicaKey, &routed{replica: r, pool: db.Statement.ConnPool})
+		db.Statement.ConnPool = r.db
+	}
+}
+
+// restore 恢复路由前的连接,返回使用的副本
+func (rs *replicaSet) restore(db *gorm.DB) {
+	rs.release(db)
+}
+
+func (rs *replicaSet) release(db *gorm.DB) *replica {
+	v, ok := db.Statement.Settings.LoadAndDelete(replicaKey)
+	if !ok {
+		return nil
+	}
+	state := v.(*routed)
+	if db.Statement.ConnPool == state.replica.db {
+		db.Statement.ConnPool = state.pool
+	}
+	return state.replica
+}
+
+// pick 按策略选择健康副本,无健康副本时返回nil使用主库
+func (rs *replicaSet) pick() *replica {
+	healthy := make([]*replica, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		if r.healthy.Load() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) <= 0 {
+		return nil
+	}
+	switch rs.policy {
+	case PolicyRoundRobin:
+		return healthy[int(rs.counter.Add(1)%uint64(len(healthy)))]
+	case PolicyLeastConn:
+		least := healthy[0]
+		for _, r := range healthy[1:] {
+			if r.db.Stats().InUse < least.db.Stats().InUse {
+				least = r
+			}
+		}
+		return least
+	default:
+		return healthy[rand.Intn(len(healthy))]
+	}
+}
+
+// eject 恢复主库连接,副本连接异常时立即摘除
+func (rs *replicaSet) eject(db *gorm.DB) {
+	r := rs.release(db)
+	if r == nil || db.Error == nil {
+		return
+	}
+	//语句超时或请求取消不代表副本异常,慢查询不应导致副本被摘除
+	if IsTimeout(db.Error) || errors.Is(db.Error, context.Canceled) || errors.Is(db.Error, context.DeadlineExceeded) {
+		return
+	}
+	var netErr net.Error
+	if errors.Is(db.Error, driver.ErrBadConn) || (errors.As(db.Error, &netErr) && !netErr.Timeout()) {
+		if r.healthy.CompareAndSwap(true, false) {
+			rs.l.Warn("副本连接异常,已摘除", zap.Int("replica", r.index), zap.Error(db.Error))
+		}
+	}
+}
+
+// check 定时检查副本,恢复的副本重新加入
+func (rs *replicaSet) check() {
+	defer func() {
+		if e := recover(); e != nil {
+			rs.l.Error("副本健康检查异常", zap.Any("error", e))
+		}
+	}()
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, r := range rs.replicas {
+				ctx, cancel := context.WithTimeout(context.Background(), rs.interval)
+				err := r.db.PingContext(ctx)
+				cancel()
+				if err != nil && r.healthy.CompareAndSwap(true, false) {
+					rs.l.Warn("副本不可用,已摘除", zap.Int("replica", r.index), zap.Error(err))
+				} else if err == nil && r.healthy.CompareAndSwap(false, true) {
+					rs.l.Info("副本已恢复", zap.Int("replica", r.index))
+				}
+			}
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+// Close 停止健康检查并关闭副本连接
+func (rs *replicaSet) Close() {
+	rs.once.Do(func() {
+		close(rs.stop)
+		for _, r := range rs.replicas {
+			_ = r.db.Close()
+		}
+	})
+}
+
+// CloseDatabase 关闭SetupDatabase创建的主库及副本连接
+func CloseDatabase(db *gorm.DB) error {
+	if plugin, ok := db.Config.Plugins[replicaPluginName]; ok {
+		plugin.(*replicaSet).Close()
+	}
+	sqldb, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqldb.Close()
+}
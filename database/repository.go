@@ -0,0 +1,268 @@
+package database
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Repository 模型T的通用增删改查,T为结构体模型,ctx中有WithTx开启的事务时使用该事务
+type Repository[T any] struct {
+	db        *gorm.DB
+	BatchSize int //批量写入每批数量,默认500
+}
+
+// PageResult 分页结果
+type PageResult[T any] struct {
+	Items []T   `json:"items"` //数据
+	Total int64 `json:"total"` //总数
+	Page  int   `json:"page"`  //页码,从1开始
+	Size  int   `json:"size"`  //每页数量
+}
+
+// CursorResult 游标分页结果
+type CursorResult[T any] struct {
+	Items   []T    `json:"items"`    //数据
+	Next    string `json:"next"`     //下一页游标,没有更多数据时为空
+	HasMore bool   `json:"has_more"` //是否有更多数据
+}
+
+// NewRepository 创建模型T的仓储
+func NewRepository[T any](db *gorm.DB) *Repository[T] {
+	return &Repository[T]{db: db, BatchSize: 500}
+}
+
+// DB 返回绑定ctx及模型的连接,用于仓储未覆盖的查询
+func (r *Repository[T]) DB(ctx context.Context) *gorm.DB {
+	return DBFromContext(ctx, r.db).Model(new(T))
+}
+
+func (r *Repository[T]) query(ctx context.Context, filters []Filter) *gorm.DB {
+	return And(filters...).Apply(r.DB(ctx))
+}
+
+// FindByID 按主键查询,不存在时返回gorm.ErrRecordNotFound
+func (r *Repository[T]) FindByID(ctx context.Context, id interface{}) (*T, error) {
+	entity := new(T)
+	if err := r.DB(ctx).Where(clause.Eq{Column: clause.PrimaryColumn, Value: id}).Take(entity).Error; err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// FindOne 查询满足条件的第一条,未指定排序时按主键排序,不存在时返回gorm.ErrRecordNotFound
+func (r *Repository[T]) FindOne(ctx context.Context, filters ...Filter) (*T, error) {
+	entity := new(T)
+	if err := r.query(ctx, filters).First(entity).Error; err != nil {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// FindAll 查询满足条件的全部数据
+func (r *Repository[T]) FindAll(ctx context.Context, filters ...Filter) (items []T, err error) {
+	err = r.query(ctx, filters).Find(&items).Error
+	return
+}
+
+// Create 创建
+func (r *Repository[T]) Create(ctx context.Context, entity *T) error {
+	return r.DB(ctx).Create(entity).Error
+}
+
+// CreateBatch 批量创建
+func (r *Repository[T]) CreateBatch(ctx context.Context, entities []T) error {
+	if len(entities) <= 0 {
+		return nil
+	}
+	return r.DB(ctx).CreateInBatches(&entities, r.BatchSize).Error
+}
+
+// Update 按主键保存全部字段,包括零值,模型包含Version时版本号不一致返回*ConflictError
+func (r *Repository[T]) Update(ctx context.Context, entity *T) error {
+	//Model与Save的数据不同时gorm不追加主键条件
+	return DBFromContext(ctx, r.db).Save(entity).Error
+}
+
+// Updates 更新满足条件的数据,必须指定条件,返回影响行数
+func (r *Repository[T]) Updates(ctx context.Context, values map[string]interface{}, filters ...Filter) (int64, error) {
+	filter := And(filters...)
+	if filter.expr == nil {
+		return 0, gorm.ErrMissingWhereClause
+	}
+	result := filter.Apply(r.DB(ctx)).Updates(values)
+	return result.RowsAffected, result.Error
+}
+
+// Delete 按主键删除,模型包含gorm.DeletedAt时为软删除
+func (r *Repository[T]) Delete(ctx context.Context, id interface{}) error {
+	return r.DB(ctx).Where(clause.Eq{Column: clause.PrimaryColumn, Value: id}).Delete(new(T)).Error
+}
+
+// DeleteWhere 删除满足条件的数据,必须指定条件,返回影响行数
+func (r *Repository[T]) DeleteWhere(ctx context.Context, filters ...Filter) (int64, error) {
+	filter := And(filters...)
+	if filter.expr == nil {
+		return 0, gorm.ErrMissingWhereClause
+	}
+	result := filter.Apply(r.DB(ctx)).Delete(new(T))
+	return result.RowsAffected, result.Error
+}
+
+// Restore 恢复满足条件的软删除数据,返回影响行数
+func (r *Repository[T]) Restore(ctx context.Context, filters ...Filter) (int64, error) {
+	field, err := r.deletedAt()
+	if err != nil {
+		return 0, err
+	}
+	result := And(append([]Filter{NotNull(field.DBName)}, filters...)...).Apply(r.DB(ctx).Unscoped()).Update(field.DBName, nil)
+	return result.RowsAffected, result.Error
+}
+
+// Purge 物理删除满足条件的软删除数据,未删除的数据不受影响,返回影响行数
+func (r *Repository[T]) Purge(ctx context.Context, filters ...Filter) (int64, error) {
+	field, err := r.deletedAt()
+	if err != nil {
+		return 0, err
+	}
+	result := And(append([]Filter{NotNull(field.DBName)}, filters...)...).Apply(r.DB(ctx).Unscoped()).Delete(new(T))
+	return result.RowsAffected, result.Error
+}
+
+// deletedAt 模型的软删除字段
+func (r *Repository[T]) deletedAt() (*schema.Field, error) {
+	stmt := &gorm.Statement{DB: r.db}
+	if err := stmt.Parse(new(T)); err != nil {
+		return nil, err
+	}
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName != "" && field.FieldType == reflect.TypeOf(gorm.DeletedAt{}) {
+			return field, nil
+		}
+	}
+	return nil, errors.Errorf("%s has no gorm.DeletedAt field", stmt.Schema.Name)
+}
+
+/*
+Upsert 批量写入,冲突时更新,参数说明:
+
+	1、conflictColumns冲突判断的列,需为主键或唯一索引,mysql忽略该参数按表上的唯一索引判断
+	2、updateColumns冲突时更新的列,为空时更新除主键外的全部列
+*/
+func (r *Repository[T]) Upsert(ctx context.Context, entities []T, conflictColumns []string, updateColumns ...string) error {
+	if len(entities) <= 0 {
+		return nil
+	}
+	onConflict := clause.OnConflict{}
+	for _, name := range conflictColumns {
+		onConflict.Columns = append(onConflict.Columns, column(name))
+	}
+	if len(updateColumns) > 0 {
+		onConflict.DoUpdates = clause.AssignmentColumns(updateColumns)
+	} else {
+		onConflict.UpdateAll = true
+	}
+	return r.DB(ctx).Clauses(onConflict).CreateInBatches(&entities, r.BatchSize).Error
+}
+
+// Count 满足条件的数量
+func (r *Repository[T]) Count(ctx context.Context, filters ...Filter) (total int64, err error) {
+	filter := And(filters...)
+	filter.order = nil
+	err = filter.Apply(r.DB(ctx)).Count(&total).Error
+	return
+}
+
+// Exists 是否存在满足条件的数据
+func (r *Repository[T]) Exists(ctx context.Context, filters ...Filter) (bool, error) {
+	var ones []int
+	filter := And(filters...)
+	filter.order = nil
+	if err := filter.Apply(r.DB(ctx)).Select("1").Limit(1).Scan(&ones).Error; err != nil {
+		return false, err
+	}
+	return len(ones) > 0, nil
+}
+
+// Page 分页查询,page从1开始,size<=0时为10
+func (r *Repository[T]) Page(ctx context.Context, page, size int, filters ...Filter) (result PageResult[T], err error) {
+	if page <= 0 {
+		page = 1
+	}
+	if size <= 0 {
+		size = 10
+	}
+	result = PageResult[T]{Items: []T{}, Page: page, Size: size}
+	if result.Total, err = r.Count(ctx, filters...); err != nil || result.Total <= 0 {
+		return
+	}
+	err = r.query(ctx, filters).Offset((page - 1) * size).Limit(size).Find(&result.Items).Error
+	return
+}
+
+/*
+Cursor 游标分页,参数说明:
+
+	1、name游标列,需唯一且有序,如主键、雪花ID
+	2、cursor上一页返回的Next,首页为空
+	3、limit每页数量,<=0时为10
+	4、desc为true时按游标列降序
+*/
+func (r *Repository[T]) Cursor(ctx context.Context, name, cursor string, limit int, desc bool, filters ...Filter) (result CursorResult[T], err error) {
+	if limit <= 0 {
+		limit = 10
+	}
+	var field *schema.Field
+	if field, err = r.field(name); err != nil {
+		return
+	}
+	tx := r.query(ctx, filters)
+	if cursor != "" {
+		var raw []byte
+		if raw, err = base64.RawURLEncoding.DecodeString(cursor); err != nil {
+			return result, errors.Wrap(err, "invalid cursor")
+		}
+		after := reflect.New(field.FieldType)
+		if err = json.Unmarshal(raw, after.Interface()); err != nil {
+			return result, errors.Wrap(err, "invalid cursor")
+		}
+		if desc {
+			tx = tx.Where(clause.Lt{Column: column(field.DBName), Value: after.Elem().Interface()})
+		} else {
+			tx = tx.Where(clause.Gt{Column: column(field.DBName), Value: after.Elem().Interface()})
+		}
+	}
+	result.Items = make([]T, 0, limit+1)
+	if err = tx.Order(clause.OrderByColumn{Column: column(field.DBName), Desc: desc}).Limit(limit + 1).Find(&result.Items).Error; err != nil {
+		return
+	}
+	if result.HasMore = len(result.Items) > limit; result.HasMore {
+		result.Items = result.Items[:limit]
+		last := reflect.ValueOf(&result.Items[limit-1]).Elem()
+		value, _ := field.ValueOf(ctx, last)
+		var raw []byte
+		if raw, err = json.Marshal(value); err != nil {
+			return
+		}
+		result.Next = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	return
+}
+
+// field 按列名或字段名查找模型字段
+func (r *Repository[T]) field(name string) (*schema.Field, error) {
+	stmt := &gorm.Statement{DB: r.db}
+	if err := stmt.Parse(new(T)); err != nil {
+		return nil, err
+	}
+	if field := stmt.Schema.LookUpField(name); field != nil {
+		return field, nil
+	}
+	return nil, errors.Errorf("field %s not found in %s", name, stmt.Schema.Name)
+}
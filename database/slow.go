@@ -0,0 +1,302 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/utils"
+)
+
+const (
+	slowPluginName = "database:slow_query"
+	slowBeginKey   = "database:slow_begin"
+	slowPoolKey    = "database:slow_pool"
+	slowMaxEntries = 1000 //报告最多保留的语句指纹数量,超出时淘汰累计耗时最少的
+)
+
+var (
+	fingerprintString  = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.)*"`)
+	fingerprintNumber  = regexp.MustCompile(`\b-?\d+(?:\.\d+)?\b`)
+	fingerprintList    = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	fingerprintSpace   = regexp.MustCompile(`\s+`)
+	fingerprintComment = regexp.MustCompile(`(?s)/\*.*?\*/|--[^\n]*`)
+)
+
+// SlowQueryConfig 慢查询配置
+type SlowQueryConfig struct {
+	Threshold            time.Duration //慢查询阈值
+	Explain              bool          //mysql、sqlite慢查询时执行EXPLAIN并记录执行计划,仅SELECT
+	ExplainInterval      time.Duration //同一语句指纹执行EXPLAIN的最小间隔,默认1分钟
+	ParameterizedQueries bool          //日志只记录带占位符的SQL
+}
+
+// SlowQueryStat 按语句指纹汇总的慢查询统计
+type SlowQueryStat struct {
+	Fingerprint string        `json:"fingerprint"` //归一化后的语句
+	SQL         string        `json:"sql"`         //最近一次的语句
+	Count       int64         `json:"count"`       //次数
+	Total       time.Duration `json:"total"`       //累计耗时
+	Max         time.Duration `json:"max"`         //最大耗时
+	Last        time.Time     `json:"last"`        //最近发生时间
+	Explain     string        `json:"explain"`     //最近一次执行计划
+}
+
+// slowQuery 慢查询插件,通过回调统计每条语句耗时
+type slowQuery struct {
+	l *zap.Logger
+	SlowQueryConfig
+	lock      sync.Mutex
+	stats     map[string]*SlowQueryStat
+	explained map[string]time.Time
+}
+
+// UseSlowQuery 注册慢查询插件
+func UseSlowQuery(l *zap.Logger, db *gorm.DB, config SlowQueryConfig) error {
+	if config.ExplainInterval <= 0 {
+		config.ExplainInterval = time.Minute
+	}
+	return db.Use(&slowQuery{
+		l:               l,
+		SlowQueryConfig: config,
+		stats:           make(map[string]*SlowQueryStat),
+		explained:       make(map[string]time.Time),
+	})
+}
+
+func (s *slowQuery) Name() string {
+	return slowPluginName
+}
+
+func (s *slowQuery) Initialize(db *gorm.DB) (err error) {
+	cb := db.Callback()
+	for _, register := range []func() error{
+		func() error { return cb.Create().Before("*").Register(slowBeginKey, s.begin) },
+		func() error { return cb.Create().After("*").Register("database:slow_end", s.end) },
+		func() error { return cb.Query().Before("*").Register(slowBeginKey, s.begin) },
+		func() error { return cb.Query().After("*").Register("database:slow_end", s.end) },
+		func() error { return cb.Update().Before("*").Register(slowBeginKey, s.begin) },
+		func() error { return cb.Update().After("*").Register("database:slow_end", s.end) },
+		func() error { return cb.Delete().Before("*").Register(slowBeginKey, s.begin) },
+		func() error { return cb.Delete().After("*").Register("database:slow_end", s.end) },
+		func() error { return cb.Row().Before("*").Register(slowBeginKey, s.begin) },
+		func() error { return cb.Row().After("*").Register("database:slow_end", s.end) },
+		//读写分离插件在查询后恢复主库连接,执行计划需在实际执行的副本上获取
+		func() error {
+			return cb.Query().After("gorm:query").Before("database:replica_eject").Register(slowPoolKey, s.pool)
+		},
+		func() error {
+			return cb.Row().After("gorm:row").Before("database:replica_eject").Register(slowPoolKey, s.pool)
+		},
+		func() error { return cb.Raw().Before("*").Register(slowBeginKey, s.begin) },
+		func() error { return cb.Raw().After("*").Register("database:slow_end", s.end) },
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *slowQuery) begin(db *gorm.DB) {
+	db.Statement.Settings.Store(slowBeginKey, time.Now())
+}
+
+// pool 记录执行语句的连接
+func (s *slowQuery) pool(db *gorm.DB) {
+	db.Statement.Settings.Store(slowPoolKey, db.Statement.ConnPool)
+}
+
+func (s *slowQuery) end(db *gorm.DB) {
+	pool := db.Statement.ConnPool
+	if v, ok := db.Statement.Settings.LoadAndDelete(slowPoolKey); ok {
+		pool = v.(gorm.ConnPool)
+	}
+	v, ok := db.Statement.Settings.LoadAndDelete(slowBeginKey)
+	if !ok {
+		return
+	}
+	elapsed := time.Since(v.(time.Time))
+	if s.Threshold <= 0 || elapsed <= s.Threshold || db.Statement.SQL.Len() <= 0 {
+		return
+	}
+	rawSQL := db.Statement.SQL.String()
+	sqlStr := rawSQL
+	if !s.ParameterizedQueries {
+		sqlStr = db.Dialector.Explain(rawSQL, db.Statement.Vars...)
+	}
+	fingerprint := Fingerprint(rawSQL)
+	fields := []zap.Field{
+		zap.String("sql", sqlStr),
+		zap.String("fingerprint", fingerprint),
+		zap.Duration("elapsed", elapsed),
+		zap.Duration("threshold", s.Threshold),
+		zap.Int64("rows", db.RowsAffected),
+		zap.String("sql_caller", utils.FileWithLineNum()),
+	}
+	var plan string
+	if s.shouldExplain(db, fingerprint) {
+		var err error
+		if plan, err = s.explain(db, pool, rawSQL); err != nil {
+			fields = append(fields, zap.NamedError("explain_error", err))
+		} else {
+			fields = append(fields, zap.String("explain", plan))
+		}
+	}
+	s.l.Warn("慢查询", fields...)
+	s.record(fingerprint, sqlStr, elapsed, plan)
+}
+
+// shouldExplain 仅mysql、sqlite的查询语句,且同一指纹在间隔内只执行一次
+func (s *slowQuery) shouldExplain(db *gorm.DB, fingerprint string) bool {
+	if !s.Explain || db.Error != nil {
+		return false
+	}
+	if name := db.Dialector.Name(); name != "mysql" && name != "sqlite" {
+		return false
+	}
+	if !strings.HasPrefix(fingerprint, "select") || strings.HasSuffix(fingerprint, "for update") {
+		return false
+	}
+	//Row()、Rows()返回时结果集尚未读取,连接仍被占用
+	switch db.Statement.Dest.(type) {
+	case *sql.Row, *sql.Rows:
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if last, ok := s.explained[fingerprint]; ok && time.Since(last) < s.ExplainInterval {
+		return false
+	}
+	if len(s.explained) >= slowMaxEntries {
+		for k, last := range s.explained {
+			if time.Since(last) >= s.ExplainInterval {
+				delete(s.explained, k)
+			}
+		}
+	}
+	s.explained[fingerprint] = time.Now()
+	return true
+}
+
+// explain 在执行原语句的连接上执行EXPLAIN,结果每行以tab分隔列
+func (s *slowQuery) explain(db *gorm.DB, pool gorm.ConnPool, rawSQL string) (plan string, err error) {
+	prefix := "EXPLAIN "
+	if db.Dialector.Name() == "sqlite" {
+		prefix = "EXPLAIN QUERY PLAN "
+	}
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var rows *sql.Rows
+	if rows, err = pool.QueryContext(ctx, prefix+rawSQL, db.Statement.Vars...); err != nil {
+		return
+	}
+	defer rows.Close()
+	var columns []string
+	if columns, err = rows.Columns(); err != nil {
+		return
+	}
+	lines := []string{strings.Join(columns, "\t")}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return
+		}
+		line := make([]string, len(values))
+		for i, v := range values {
+			if v.Valid {
+				line[i] = v.String
+			} else {
+				line[i] = "NULL"
+			}
+		}
+		lines = append(lines, strings.Join(line, "\t"))
+	}
+	return strings.Join(lines, "\n"), rows.Err()
+}
+
+func (s *slowQuery) record(fingerprint, sqlStr string, elapsed time.Duration, plan string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stat, ok := s.stats[fingerprint]
+	if !ok {
+		if len(s.stats) >= slowMaxEntries {
+			var evict *SlowQueryStat
+			for _, v := range s.stats {
+				if evict == nil || v.Total < evict.Total {
+					evict = v
+				}
+			}
+			delete(s.stats, evict.Fingerprint)
+		}
+		stat = &SlowQueryStat{Fingerprint: fingerprint}
+		s.stats[fingerprint] = stat
+	}
+	stat.SQL = sqlStr
+	stat.Count++
+	stat.Total += elapsed
+	if elapsed > stat.Max {
+		stat.Max = elapsed
+	}
+	stat.Last = time.Now()
+	if plan != "" {
+		stat.Explain = plan
+	}
+}
+
+// SlowQueries 按累计耗时倒序返回前n条慢查询统计,n<=0时返回全部,未开启慢查询时返回nil
+func SlowQueries(db *gorm.DB, n int) (stats []SlowQueryStat) {
+	plugin, ok := db.Config.Plugins[slowPluginName]
+	if !ok {
+		return
+	}
+	s := plugin.(*slowQuery)
+	s.lock.Lock()
+	for _, v := range s.stats {
+		stats = append(stats, *v)
+	}
+	s.lock.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Total == stats[j].Total {
+			return stats[i].Max > stats[j].Max
+		}
+		return stats[i].Total > stats[j].Total
+	})
+	if n > 0 && len(stats) > n {
+		stats = stats[:n]
+	}
+	return
+}
+
+// ResetSlowQueries 清空慢查询统计
+func ResetSlowQueries(db *gorm.DB) {
+	if plugin, ok := db.Config.Plugins[slowPluginName]; ok {
+		s := plugin.(*slowQuery)
+		s.lock.Lock()
+		s.stats = make(map[string]*SlowQueryStat)
+		s.explained = make(map[string]time.Time)
+		s.lock.Unlock()
+	}
+}
+
+// Fingerprint 语句指纹,去除注释,字符串及数字替换为?,IN列表合并,空白归一并转小写
+func Fingerprint(sqlStr string) string {
+	sqlStr = fingerprintComment.ReplaceAllString(sqlStr, " ")
+	sqlStr = fingerprintString.ReplaceAllString(sqlStr, "?")
+	sqlStr = fingerprintNumber.ReplaceAllString(sqlStr, "?")
+	sqlStr = fingerprintList.ReplaceAllString(sqlStr, "(?+)")
+	sqlStr = fingerprintSpace.ReplaceAllString(sqlStr, " ")
+	return strings.ToLower(strings.TrimSpace(sqlStr))
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// SQLiteConfig sqlite连接选项,PRAGMA在每个新建连接上执行
+type SQLiteConfig struct {
+	JournalMode  string `yaml:"journal_mode"`  //日志模式,DELETE|TRUNCATE|PERSIST|MEMORY|WAL|OFF,默认WAL
+	BusyTimeout  int    `yaml:"busy_timeout"`  //数据库被锁时的等待时间,单位毫秒,默认5000,小于0时不等待
+	Synchronous  string `yaml:"synchronous"`   //同步模式,OFF|NORMAL|FULL|EXTRA,为空时使用sqlite默认值
+	ForeignKeys  bool   `yaml:"foreign_keys"`  //启用外键约束
+	CacheSize    int    `yaml:"cache_size"`    //页缓存大小,正数为页数,负数为KiB,为0时使用sqlite默认值
+	MmapSize     int64  `yaml:"mmap_size"`     //内存映射大小,单位字节,为0时使用sqlite默认值
+	TempStore    string `yaml:"temp_store"`    //临时表存储位置,DEFAULT|FILE|MEMORY
+	SharedMemory bool   `yaml:"shared_memory"` //共享内存数据库,dsn作为数据库名,同一进程内的连接共享数据,用于测试
+	SingleWriter bool   `yaml:"single_writer"` //单写连接,写入及事务使用唯一的写连接串行执行,查询使用独立的读连接池
+}
+
+var (
+	sqliteSynchronous = map[string]bool{"OFF": true, "NORMAL": true, "FULL": true, "EXTRA": true}
+	sqliteTempStore   = map[string]bool{"DEFAULT": true, "FILE": true, "MEMORY": true}
+	sqliteJournalMode = map[string]bool{"DELETE": true, "TRUNCATE": true, "PERSIST": true, "MEMORY": true, "WAL": true, "OFF": true}
+)
+
+// sqliteDSN 共享内存模式时转换为内存数据库URI
+func sqliteDSN(dsn string, config SQLiteConfig) string {
+	if !config.SharedMemory {
+		return dsn
+	}
+	name := strings.TrimPrefix(dsn, "file:")
+	if name == "" || name == ":memory:" {
+		name = "memdb"
+	}
+	if i := strings.IndexByte(name, '?'); i >= 0 {
+		name = name[:i]
+	}
+	return "file:" + name + "?mode=memory&cache=shared"
+}
+
+// sqlitePragmas 按配置生成连接初始化语句
+func sqlitePragmas(config SQLiteConfig) (pragmas []string, err error) {
+	journalMode := strings.ToUpper(config.JournalMode)
+	if journalMode == "" {
+		journalMode = "WAL"
+	}
+	if !sqliteJournalMode[journalMode] {
+		return nil, errors.Errorf("unsupported sqlite journal_mode:%s", config.JournalMode)
+	}
+	pragmas = append(pragmas, "PRAGMA journal_mode="+journalMode)
+	switch {
+	case config.BusyTimeout == 0:
+		pragmas = append(pragmas, "PRAGMA busy_timeout=5000")
+	case config.BusyTimeout > 0:
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout=%d", config.BusyTimeout))
+	}
+	if config.Synchronous != "" {
+		if !sqliteSynchronous[strings.ToUpper(config.Synchronous)] {
+			return nil, errors.Errorf("unsupported sqlite synchronous:%s", config.Synchronous)
+		}
+		pragmas = append(pragmas, "PRAGMA synchronous="+strings.ToUpper(config.Synchronous))
+	}
+	if config.ForeignKeys {
+		pragmas = append(pragmas, "PRAGMA foreign_keys=ON")
+	}
+	if config.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size=%d", config.CacheSize))
+	}
+	if config.MmapSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA mmap_size=%d", config.MmapSize))
+	}
+	if config.TempStore != "" {
+		if !sqliteTempStore[strings.ToUpper(config.TempStore)] {
+			return nil, errors.Errorf("unsupported sqlite temp_store:%s", config.TempStore)
+		}
+		pragmas = append(pragmas, "PRAGMA temp_store="+strings.ToUpper(config.TempStore))
+	}
+	return
+}
+
+// sqliteConnector 新建连接时执行PRAGMA,busy_timeout等选项只对当前连接有效
+type sqliteConnector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+func (c *sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sqliteDialector 创建按配置初始化连接的sqlite方言,配置错误时在Initialize返回
+func sqliteDialector(dsn string, inParams Database) gorm.Dialector {
+	dsn = sqliteDSN(dsn, inParams.SQLite)
+	pragmas, err := sqlitePragmas(inParams.SQLite)
+	if err != nil {
+		return invalidDialector{Dialector: sqlite.Open(dsn), err: err}
+	}
+	return &sqlite.Dialector{DSN: dsn, Conn: sql.OpenDB(&sqliteConnector{
+		dsn: dsn,
+		driver: &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			for _, pragma := range pragmas {
+				if _, err := conn.Exec(pragma, nil); err != nil {
+					return errors.Wrap(err, pragma)
+				}
+			}
+			return nil
+		}},
+	})}
+}
+
+// sqliteInit 调整连接池,共享内存数据库至少保留一个连接,单写连接时主连接池只保留一个连接
+func sqliteInit(db *gorm.DB, inParams Database) (err error) {
+	var sqldb *sql.DB
+	if sqldb, err = db.DB(); err != nil {
+		return
+	}
+	if inParams.SQLite.SharedMemory {
+		//最后一个连接关闭时内存数据库被删除
+		if inParams.MaxIdleConns < 1 {
+			sqldb.SetMaxIdleConns(1)
+		}
+		sqldb.SetConnMaxLifetime(0)
+	}
+	if inParams.SQLite.SingleWriter {
+		sqldb.SetMaxOpenConns(1)
+		sqldb.SetMaxIdleConns(1)
+	}
+	return
+}
+
+// invalidDialector 配置错误时在打开连接时返回错误
+type invalidDialector struct {
+	gorm.Dialector
+	err error
+}
+
+func (d invalidDialector) Initialize(*gorm.DB) error {
+	return d.err
+}
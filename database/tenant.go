@@ -0,0 +1,286 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	tenantPluginName = "database:tenant"
+	allTenantsKey    = "database:all_tenants"
+)
+
+var (
+	// ErrTenantMissing 操作包含租户列的模型时ctx中没有租户
+	ErrTenantMissing = errors.New("tenant missing in context")
+	// ErrTenantMismatch 写入的数据属于其他租户
+	ErrTenantMismatch = errors.New("tenant mismatch")
+	// ErrTenantUnscoped 只指定表名(如Table("doc").Find(&maps))操作租户表,无法按租户过滤
+	ErrTenantUnscoped = errors.New("tenant table accessed without model")
+	// ErrTenantUpsert 租户表的upsert冲突列不含租户列,可能覆盖其他租户的数据
+	ErrTenantUpsert = errors.New("tenant upsert conflict target without tenant column")
+)
+
+type (
+	tenantCtxKey     struct{}
+	allTenantsCtxKey struct{}
+)
+
+// TenantConfig 多租户配置
+type TenantConfig struct {
+	Column     string                            //租户列名,默认tenant_id,包含该列的模型自动按租户过滤
+	ContextKey string                            //未使用WithTenant时,从ctx读取租户的key,默认tenant_id,gin.Context可直接读取c.Set的值
+	Schema     func(tenant string) string        //不为空时表名加上返回的schema前缀,用于每个租户独立schema
+	Pool       func(tenant string) gorm.ConnPool //不为空时事务外的语句使用返回的连接,用于每个租户独立数据库,返回nil时使用默认连接
+	Tables     []string                          //包含租户列的表,与RegisterModels注册及已执行过的模型一起用于拒绝只指定表名的语句
+}
+
+// WithTenant ctx附加租户
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, tenant)
+}
+
+// WithoutTenant 标记ctx内的语句不按租户过滤,用于跨租户的管理任务
+func WithoutTenant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, allTenantsCtxKey{}, true)
+}
+
+// AllTenants 当前语句不按租户过滤
+func AllTenants(db *gorm.DB) *gorm.DB {
+	return db.Set(allTenantsKey, true)
+}
+
+// tenant 多租户插件,查询、修改、删除追加租户条件,创建时设置租户,ctx中没有租户时返回ErrTenantMissing
+type tenant struct {
+	TenantConfig
+	tables sync.Map
+}
+
+/*
+UseTenant 注册多租户插件,说明:
+
+	1、通过模型执行的语句按租户过滤,原生SQL不处理
+	2、不含租户列的模型只应用Schema、Pool路由
+	3、WithoutTenant、AllTenants跳过过滤及路由
+	4、只指定表名操作租户表时返回ErrTenantUnscoped,需改用模型或跳过过滤
+	5、租户表的upsert(含Save找不到数据时的插入)冲突列不含租户列时返回ErrTenantUpsert,Save只用于更新已存在的数据
+*/
+func UseTenant(db *gorm.DB, config TenantConfig) error {
+	if config.Column == "" {
+		config.Column = "tenant_id"
+	}
+	if config.ContextKey == "" {
+		config.ContextKey = "tenant_id"
+	}
+	t := &tenant{TenantConfig: config}
+	for _, table := range config.Tables {
+		t.tables.Store(table, true)
+	}
+	return db.Use(t)
+}
+
+func (t *tenant) Name() string {
+	return tenantPluginName
+}
+
+func (t *tenant) Initialize(db *gorm.DB) (err error) {
+	cacheStore := &sync.Map{}
+	for _, model := range RegisteredModels() {
+		var s *schema.Schema
+		if s, err = schema.Parse(model, cacheStore, db.NamingStrategy); err != nil {
+			return
+		}
+		t.register(s)
+	}
+	cb := db.Callback()
+	for _, register := range []func() error{
+		func() error { return cb.Create().Before("gorm:create").Register(tenantPluginName, t.create) },
+		func() error { return cb.Query().Before("gorm:query").Register(tenantPluginName, t.filter) },
+		func() error { return cb.Row().Before("gorm:row").Register(tenantPluginName, t.filter) },
+		func() error { return cb.Update().Before("gorm:update").Register(tenantPluginName, t.filter) },
+		func() error { return cb.Delete().Before("gorm:delete").Register(tenantPluginName, t.filter) },
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// register 记录包含租户列的表
+func (t *tenant) register(s *schema.Schema) {
+	if s != nil && s.Table != "" && s.LookUpField(t.Column) != nil {
+		t.tables.Store(s.Table, true)
+	}
+}
+
+// tenantTable 表名是否为租户表,忽略别名、schema前缀及引号
+func (t *tenant) tenantTable(table string) bool {
+	fields := strings.Fields(table)
+	if len(fields) == 0 {
+		return false
+	}
+	name := fields[0]
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	_, ok := t.tables.Load(strings.Trim(name, "`\"[]"))
+	return ok
+}
+
+// resolve 返回当前语句的租户,skip为true时不处理
+func (t *tenant) resolve(db *gorm.DB) (id string, skip bool, err error) {
+	if db.Error != nil {
+		return "", true, nil
+	}
+	if _, ok := db.Statement.Settings.Load(allTenantsKey); ok {
+		return "", true, nil
+	}
+	ctx := db.Statement.Context
+	if ctx != nil && ctx.Value(allTenantsCtxKey{}) != nil {
+		return "", true, nil
+	}
+	if db.Statement.Schema == nil {
+		if t.tenantTable(db.Statement.Table) {
+			return "", false, errors.Wrapf(ErrTenantUnscoped, "table %s", db.Statement.Table)
+		}
+		return "", true, nil
+	}
+	t.register(db.Statement.Schema)
+	if ctx != nil {
+		if v, ok := ctx.Value(tenantCtxKey{}).(string); ok && v != "" {
+			return v, false, nil
+		}
+		if v := ctx.Value(t.ContextKey); v != nil {
+			if id = fmt.Sprint(v); id != "" {
+				return
+			}
+		}
+	}
+	if db.Statement.Schema.LookUpField(t.Column) == nil && t.Schema == nil && t.Pool == nil {
+		return "", true, nil
+	}
+	return "", false, errors.Wrapf(ErrTenantMissing, "table %s", db.Statement.Table)
+}
+
+// route 按租户切换schema及连接
+func (t *tenant) route(db *gorm.DB, id string) {
+	stmt := db.Statement
+	if t.Schema != nil && stmt.Table != "" && !strings.Contains(stmt.Table, ".") {
+		if name := t.Schema(id); name != "" {
+			stmt.Table = name + "." + stmt.Table
+		}
+	}
+	if t.Pool != nil {
+		if _, ok := stmt.ConnPool.(gorm.TxCommitter); !ok {
+			if pool := t.Pool(id); pool != nil {
+				stmt.ConnPool = pool
+			}
+		}
+	}
+}
+
+func (t *tenant) filter(db *gorm.DB) {
+	id, skip, err := t.resolve(db)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	if skip {
+		return
+	}
+	t.route(db, id)
+	if field := db.Statement.Schema.LookUpField(t.Column); field != nil {
+		db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+			clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: id},
+		}})
+	}
+}
+
+// create 设置租户列,已有其他租户的值时拒绝写入
+func (t *tenant) create(db *gorm.DB) {
+	id, skip, err := t.resolve(db)
+	if err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	if skip {
+		return
+	}
+	t.route(db, id)
+	field := db.Statement.Schema.LookUpField(t.Column)
+	if field == nil {
+		return
+	}
+	stmt := db.Statement
+	if err = t.upsert(stmt, field); err != nil {
+		_ = db.AddError(err)
+		return
+	}
+	switch stmt.ReflectValue.Kind() {
+	case reflect.Struct:
+		_ = db.AddError(t.assign(stmt, field, stmt.ReflectValue, id))
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < stmt.ReflectValue.Len(); i++ {
+			if err = t.assign(stmt, field, reflect.Indirect(stmt.ReflectValue.Index(i)), id); err != nil {
+				_ = db.AddError(err)
+				return
+			}
+		}
+	case reflect.Map:
+		//Model(&T{}).Create(map)
+		switch values := stmt.Dest.(type) {
+		case map[string]interface{}:
+			values[field.DBName] = id
+		case *map[string]interface{}:
+			(*values)[field.DBName] = id
+		case []map[string]interface{}:
+			for _, v := range values {
+				v[field.DBName] = id
+			}
+		}
+	}
+}
+
+// upsert 冲突时更新的语句,冲突列需包含租户列,否则按主键等冲突时会更新其他租户的数据
+func (t *tenant) upsert(stmt *gorm.Statement, field *schema.Field) error {
+	c, ok := stmt.Clauses["ON CONFLICT"]
+	if !ok {
+		return nil
+	}
+	onConflict, ok := c.Expression.(clause.OnConflict)
+	if !ok || onConflict.DoNothing || (!onConflict.UpdateAll && len(onConflict.DoUpdates) == 0) {
+		return nil
+	}
+	for _, column := range onConflict.Columns {
+		if column.Name == field.DBName {
+			return nil
+		}
+	}
+	return errors.Wrapf(ErrTenantUpsert, "table %s", stmt.Table)
+}
+
+func (t *tenant) assign(stmt *gorm.Statement, field *schema.Field, rv reflect.Value, id string) error {
+	value, zero := field.ValueOf(stmt.Context, rv)
+	if zero {
+		return field.Set(stmt.Context, rv, id)
+	}
+	if fmt.Sprint(value) != id {
+		return errors.Wrapf(ErrTenantMismatch, "table %s: %v != %s", stmt.Table, value, id)
+	}
+	return nil
+}
+
+// TenantFromContext ctx中的租户
+func TenantFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(tenantCtxKey{}).(string)
+	return id, ok && id != ""
+}
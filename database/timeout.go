@@ -0,0 +1,106 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+const (
+	timeoutPluginName = "database:timeout"
+	timeoutStateKey   = "database:timeout_state"
+)
+
+// timeoutState 语句执行前的ctx及超时的取消函数
+type timeoutState struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// statementTimeout ctx没有截止时间的语句使用默认超时
+type statementTimeout struct {
+	timeout time.Duration
+}
+
+/*
+UseStatementTimeout 注册默认语句超时插件,说明:
+
+	1、ctx没有截止时间的语句按timeout执行,已有截止时间的以ctx为准
+	2、Row、Rows及Raw().Scan等经过Row回调的语句返回后仍在读取结果,无法在结束时释放超时,不使用默认超时,需要时由ctx设置截止时间
+	3、Begin、Commit不经过回调,事务内的每条语句单独计时
+*/
+func UseStatementTimeout(db *gorm.DB, timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	return db.Use(&statementTimeout{timeout: timeout})
+}
+
+func (t *statementTimeout) Name() string {
+	return timeoutPluginName
+}
+
+func (t *statementTimeout) Initialize(db *gorm.DB) (err error) {
+	cb := db.Callback()
+	for _, register := range []func() error{
+		func() error { return cb.Create().Before("*").Register(timeoutPluginName, t.begin) },
+		func() error { return cb.Create().After("*").Register("database:timeout_end", t.end) },
+		func() error { return cb.Query().Before("*").Register(timeoutPluginName, t.begin) },
+		func() error { return cb.Query().After("*").Register("database:timeout_end", t.end) },
+		func() error { return cb.Update().Before("*").Register(timeoutPluginName, t.begin) },
+		func() error { return cb.Update().After("*").Register("database:timeout_end", t.end) },
+		func() error { return cb.Delete().Before("*").Register(timeoutPluginName, t.begin) },
+		func() error { return cb.Delete().After("*").Register("database:timeout_end", t.end) },
+		func() error { return cb.Raw().Before("*").Register(timeoutPluginName, t.begin) },
+		func() error { return cb.Raw().After("*").Register("database:timeout_end", t.end) },
+	} {
+		if err = register(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (t *statementTimeout) begin(db *gorm.DB) {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, t.timeout)
+	db.Statement.Settings.Store(timeoutStateKey, timeoutState{ctx: db.Statement.Context, cancel: cancel})
+	db.Statement.Context = timeoutCtx
+}
+
+// end 释放超时并恢复语句原来的ctx,链式调用再次执行时重新计时
+func (t *statementTimeout) end(db *gorm.DB) {
+	v, ok := db.Statement.Settings.LoadAndDelete(timeoutStateKey)
+	if !ok {
+		return
+	}
+	state := v.(timeoutState)
+	state.cancel()
+	db.Statement.Context = state.ctx
+}
+
+// IsTimeout 是否为超时错误,包括ctx超时、mysql max_execution_time及postgres statement_timeout
+func IsTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var mysqlErr *mysqlDriver.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 3024
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "57014"
+}
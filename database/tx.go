@@ -0,0 +1,170 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// TxOptions 事务选项
+type TxOptions struct {
+	Isolation  sql.IsolationLevel //隔离级别,默认使用数据库默认级别,sqlite不支持
+	ReadOnly   bool               //只读事务,sqlite不支持
+	Timeout    time.Duration      //单次执行超时,为0时不限制
+	MaxRetries int                //可重试错误(死锁、锁等待超时、SQLITE_BUSY等)的最大重试次数,为0时不重试
+	Backoff    time.Duration      //首次重试等待时间,之后每次翻倍并加入随机抖动,默认20毫秒
+	MaxBackoff time.Duration      //最大重试等待时间,默认1秒
+	Retryable  func(error) bool   //自定义可重试错误判断,为空时按驱动判断
+}
+
+type txCtxKey struct{}
+
+// txState ctx中的事务,嵌套事务各自持有提交后回调,成功时并入上层
+type txState struct {
+	tx     *gorm.DB
+	depth  int
+	parent *txState
+	hooks  []func(ctx context.Context)
+}
+
+/*
+WithTx 在事务中执行fn,参数说明:
+
+	1、ctx中已有事务时使用保存点嵌套执行,fn出错时只回滚到保存点,嵌套事务不重试,选项无效
+	2、fn应使用传入的ctx及tx,通过DBFromContext获取事务的代码同样加入该事务
+	3、fn返回错误或panic时回滚,可重试错误按选项退避后重新执行fn,fn需保证可重复执行
+	4、AfterCommit注册的回调在最外层事务提交成功后执行
+*/
+func WithTx(ctx context.Context, db *gorm.DB, opts *TxOptions, fn func(ctx context.Context, tx *gorm.DB) error) (err error) {
+	if parent, ok := ctx.Value(txCtxKey{}).(*txState); ok {
+		return nested(ctx, parent, fn)
+	}
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+	backoff := opts.Backoff
+	if backoff <= 0 {
+		backoff = 20 * time.Millisecond
+	}
+	maxBackoff := opts.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		var hooks []func(ctx context.Context)
+		if hooks, err = runTx(ctx, db, opts, fn); err == nil {
+			for _, hook := range hooks {
+				hook(ctx)
+			}
+			return
+		}
+		if attempt >= opts.MaxRetries || !isRetryable(db, opts, err) {
+			return
+		}
+		//等待时间在[backoff/2, backoff)之间随机
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), err.Error())
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func runTx(ctx context.Context, db *gorm.DB, opts *TxOptions, fn func(ctx context.Context, tx *gorm.DB) error) (hooks []func(ctx context.Context), err error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	var txOpts *sql.TxOptions
+	if opts.Isolation != sql.LevelDefault || opts.ReadOnly {
+		txOpts = &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly}
+	}
+	tx := db.WithContext(ctx).Begin(txOpts)
+	if err = tx.Error; err != nil {
+		return
+	}
+	state := &txState{tx: tx}
+	ctx = context.WithValue(ctx, txCtxKey{}, state)
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			tx.Rollback()
+		}
+	}()
+	if err = fn(ctx, tx.WithContext(ctx)); err == nil {
+		err = tx.Commit().Error
+	}
+	panicked = false
+	return state.hooks, err
+}
+
+func nested(ctx context.Context, parent *txState, fn func(ctx context.Context, tx *gorm.DB) error) (err error) {
+	state := &txState{tx: parent.tx, depth: parent.depth + 1, parent: parent}
+	name := fmt.Sprintf("sp%d", state.depth)
+	if err = parent.tx.Session(&gorm.Session{}).SavePoint(name).Error; err != nil {
+		return
+	}
+	ctx = context.WithValue(ctx, txCtxKey{}, state)
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			parent.tx.Session(&gorm.Session{}).RollbackTo(name)
+		}
+	}()
+	if err = fn(ctx, parent.tx.WithContext(ctx)); err == nil {
+		parent.hooks = append(parent.hooks, state.hooks...)
+	}
+	panicked = false
+	return
+}
+
+// AfterCommit 注册最外层事务提交成功后执行的回调,所在的嵌套事务回滚时回调丢弃,ctx中无事务时立即执行
+func AfterCommit(ctx context.Context, hook func(ctx context.Context)) {
+	if state, ok := ctx.Value(txCtxKey{}).(*txState); ok {
+		state.hooks = append(state.hooks, hook)
+		return
+	}
+	hook(ctx)
+}
+
+// DBFromContext 返回ctx中的事务,无事务时返回db.WithContext(ctx)
+func DBFromContext(ctx context.Context, db *gorm.DB) *gorm.DB {
+	if state, ok := ctx.Value(txCtxKey{}).(*txState); ok {
+		return state.tx.WithContext(ctx)
+	}
+	return db.WithContext(ctx)
+}
+
+// InTx ctx中是否有事务
+func InTx(ctx context.Context) bool {
+	_, ok := ctx.Value(txCtxKey{}).(*txState)
+	return ok
+}
+
+// IsRetryable 按db使用的驱动判断错误可否重试事务
+func IsRetryable(db *gorm.DB, err error) bool {
+	return isRetryable(db, nil, err)
+}
+
+func isRetryable(db *gorm.DB, opts *TxOptions, err error) bool {
+	if err == nil {
+		return false
+	}
+	if opts != nil && opts.Retryable != nil {
+		return opts.Retryable(err)
+	}
+	if driver, ok := lookupDriver(db.Dialector.Name()); ok && driver.Retryable != nil {
+		return driver.Retryable(err)
+	}
+	return false
+}
@@ -0,0 +1,461 @@
+package openapi
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	refPrefix = "#/components/schemas/"
+	nameClean = regexp.MustCompile(`[^A-Za-z0-9_.\-]+`)
+	// oneofValues 与validator一致,单引号包裹的值可含空格
+	oneofValues = regexp.MustCompile(`'[^']*'|\S+`)
+	// rfc3339Layouts 与date-time格式一致的时间布局
+	rfc3339Layouts = map[string]bool{
+		time.RFC3339:                       true,
+		time.RFC3339Nano:                   true,
+		"2006-01-02T15:04:05.000Z07:00":    true,
+		"2006-01-02T15:04:05.000000Z07:00": true,
+		"2006-01-02T15:04:05.999999Z07:00": true,
+		"2006-01-02T15:04:05.999Z07:00":    true,
+	}
+	// layoutTokens 时间布局中的数字元素与正则表达式的对应关系,按长度优先匹配
+	layoutTokens = []struct{ token, pattern string }{
+		{"2006", `\d{4}`},
+		{"002", `\d{3}`},
+		{"Z07:00", `(?:Z|[+-]\d{2}:\d{2})`},
+		{"-07:00", `[+-]\d{2}:\d{2}`},
+		{"Z0700", `(?:Z|[+-]\d{4})`},
+		{"-0700", `[+-]\d{4}`},
+		{"01", `\d{2}`},
+		{"02", `\d{2}`},
+		{"15", `\d{2}`},
+		{"03", `\d{2}`},
+		{"04", `\d{2}`},
+		{"05", `\d{2}`},
+		{"06", `\d{2}`},
+	}
+	// formats 校验规则与OpenAPI format的对应关系
+	formats = map[string]string{
+		"email":    "email",
+		"ip":       "ip",
+		"ipv4":     "ipv4",
+		"ipv6":     "ipv6",
+		"uuid":     "uuid",
+		"uuid4":    "uuid",
+		"url":      "uri",
+		"uri":      "uri",
+		"hostname": "hostname",
+		"base64":   "byte",
+	}
+	// patterns 校验规则与正则表达式的对应关系
+	patterns = map[string]string{
+		"alpha":    "^[a-zA-Z]+$",
+		"alphanum": "^[a-zA-Z0-9]+$",
+		"numeric":  "^[-+]?[0-9]+(?:\\.[0-9]+)?$",
+		"number":   "^[0-9]+$",
+	}
+)
+
+// Generator 通过反射结构体及校验标签生成Schema,具名结构体写入components并以$ref引用
+type Generator struct {
+	sync.Mutex
+	TagName    string //校验标签名称,默认binding(gin),使用validator原生标签时设置为validate
+	components map[string]*Schema
+	names      map[reflect.Type]string
+}
+
+func NewGenerator() *Generator {
+	return &Generator{
+		TagName:    "binding",
+		components: make(map[string]*Schema),
+		names:      make(map[reflect.Type]string),
+	}
+}
+
+// Schema 生成v对应的Schema
+func (g *Generator) Schema(v interface{}) *Schema {
+	g.Lock()
+	defer g.Unlock()
+	return g.schemaOf(reflect.TypeOf(v))
+}
+
+// Components 已生成的具名结构体Schema,用于components.schemas
+func (g *Generator) Components() map[string]*Schema {
+	g.Lock()
+	defer g.Unlock()
+	components := make(map[string]*Schema, len(g.components))
+	for name, schema := range g.components {
+		components[name] = schema
+	}
+	return components
+}
+
+// Parameters 按form标签将结构体字段生成query参数
+func (g *Generator) Parameters(v interface{}) (parameters []Parameter) {
+	g.Lock()
+	defer g.Unlock()
+	t := indirect(reflect.TypeOf(v))
+	if t == nil || t.Kind() != reflect.Struct {
+		return
+	}
+	g.eachField(t, []string{"form", "json"}, func(name string, field reflect.StructField) {
+		schema := g.schemaOf(field.Type)
+		parameters = append(parameters, Parameter{
+			Name:     name,
+			In:       "query",
+			Required: g.applyRules(schema, field.Type, field.Tag.Get(g.TagName)),
+			Schema:   schema,
+		})
+	})
+	return
+}
+
+func (g *Generator) schemaOf(t reflect.Type) *Schema {
+	t = indirect(t)
+	if t == nil {
+		return &Schema{}
+	}
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := g.nameOf(t)
+		if _, ok := g.components[name]; !ok {
+			//先占位,避免自引用结构体无限递归
+			placeholder := &Schema{}
+			g.components[name] = placeholder
+			*placeholder = *g.structSchema(t)
+		}
+		return &Schema{Ref: refPrefix + name}
+	default:
+		return &Schema{}
+	}
+}
+
+func (g *Generator) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	g.eachField(t, []string{"json", "form"}, func(name string, field reflect.StructField) {
+		property := g.schemaOf(field.Type)
+		if g.applyRules(property, field.Type, field.Tag.Get(g.TagName)) {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = property
+	})
+	return schema
+}
+
+// nameOf 组件名称,不同包的同名结构体以包名区分
+func (g *Generator) nameOf(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := nameClean.ReplaceAllString(t.Name(), "_")
+	for other, used := range g.names {
+		if used == name && other != t {
+			pkg := t.PkgPath()
+			name = nameClean.ReplaceAllString(pkg[strings.LastIndex(pkg, "/")+1:]+"."+t.Name(), "_")
+			break
+		}
+	}
+	g.names[t] = name
+	return name
+}
+
+// eachField 遍历可导出字段,匿名嵌入结构体展开,字段名称按tags顺序取标签,若无,则返回字段名称
+func (g *Generator) eachField(t reflect.Type, tags []string, fn func(name string, field reflect.StructField)) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		var name string
+		for _, tag := range tags {
+			if name = strings.Split(field.Tag.Get(tag), ",")[0]; name != "" {
+				break
+			}
+		}
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			if ft := indirect(field.Type); ft.Kind() == reflect.Struct {
+				g.eachField(ft, tags, fn)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fn(name, field)
+	}
+}
+
+// applyRules 将校验规则写入schema,返回是否必填
+func (g *Generator) applyRules(schema *Schema, t reflect.Type, tag string) (required bool) {
+	if tag == "" || tag == "-" {
+		return
+	}
+	return applyRules(schema, t, strings.Split(tag, ","))
+}
+
+func applyRules(schema *Schema, t reflect.Type, rules []string) (required bool) {
+	defer wrapRef(schema)
+	t = indirect(t)
+	for i := 0; i < len(rules); i++ {
+		rule := strings.TrimSpace(rules[i])
+		//或规则无法用单个schema描述,忽略
+		if rule == "" || strings.Contains(rule, "|") {
+			continue
+		}
+		//map键规则,忽略
+		if rule == "keys" {
+			for i < len(rules) && rules[i] != "endkeys" {
+				i++
+			}
+			continue
+		}
+		//dive之后的规则作用于元素
+		if rule == "dive" {
+			switch t.Kind() {
+			case reflect.Slice, reflect.Array:
+				if schema.Items != nil {
+					applyRules(schema.Items, t.Elem(), rules[i+1:])
+				}
+			case reflect.Map:
+				if schema.AdditionalProperties != nil {
+					applyRules(schema.AdditionalProperties, t.Elem(), rules[i+1:])
+				}
+			}
+			return
+		}
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = true
+		case "min", "gte":
+			lowerBound(schema, t, param, false)
+		case "gt":
+			lowerBound(schema, t, param, true)
+		case "max", "lte":
+			upperBound(schema, t, param, false)
+		case "lt":
+			upperBound(schema, t, param, true)
+		case "len":
+			lowerBound(schema, t, param, false)
+			upperBound(schema, t, param, false)
+		case "eq":
+			switch t.Kind() {
+			case reflect.Slice, reflect.Array, reflect.Map:
+				lowerBound(schema, t, param, false)
+				upperBound(schema, t, param, false)
+			default:
+				schema.Enum = []interface{}{enumValue(t, param)}
+			}
+		case "oneof":
+			schema.Enum = nil
+			for _, value := range oneofValues.FindAllString(param, -1) {
+				schema.Enum = append(schema.Enum, enumValue(t, strings.Trim(value, "'")))
+			}
+		case "unique":
+			if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+				schema.UniqueItems = true
+			}
+		case "datetime":
+			//date-time及date要求RFC3339格式,其他布局以正则描述
+			switch {
+			case rfc3339Layouts[param]:
+				schema.Format = "date-time"
+			case param == time.DateOnly:
+				schema.Format = "date"
+			default:
+				schema.Pattern = layoutPattern(param)
+			}
+			schema.Description = strings.TrimSpace(schema.Description + " layout: " + param)
+		case "startswith":
+			schema.Pattern = "^" + regexp.QuoteMeta(param)
+		case "endswith":
+			schema.Pattern = regexp.QuoteMeta(param) + "$"
+		default:
+			if format, ok := formats[name]; ok {
+				schema.Format = format
+			} else if pattern, ok := patterns[name]; ok {
+				schema.Pattern = pattern
+			}
+		}
+	}
+	return
+}
+
+// wrapRef OpenAPI 3.0忽略$ref的同级关键字,存在同级关键字时将$ref放入allOf
+func wrapRef(schema *Schema) {
+	if schema.Ref == "" {
+		return
+	}
+	siblings := *schema
+	siblings.Ref = ""
+	if reflect.DeepEqual(siblings, Schema{}) {
+		return
+	}
+	schema.AllOf, schema.Ref = []*Schema{{Ref: schema.Ref}}, ""
+}
+
+// layoutPattern 将时间布局转换为正则表达式,含月份名称、星期等非数字元素时返回空
+func layoutPattern(layout string) string {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	for layout != "" {
+		matched := false
+		for _, item := range layoutTokens {
+			if strings.HasPrefix(layout, item.token) {
+				pattern.WriteString(item.pattern)
+				layout = layout[len(item.token):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		//小数秒
+		if (layout[0] == '.' || layout[0] == ',') && len(layout) > 1 && (layout[1] == '0' || layout[1] == '9') {
+			n := 1
+			for n < len(layout) && layout[n] == layout[1] {
+				n++
+			}
+			if layout[1] == '0' {
+				pattern.WriteString(`[.,]\d{` + strconv.Itoa(n-1) + `}`)
+			} else {
+				pattern.WriteString(`(?:[.,]\d{1,` + strconv.Itoa(n-1) + `})?`)
+			}
+			layout = layout[n:]
+			continue
+		}
+		for _, token := range []string{"Jan", "Mon", "MST", "PM", "pm", "_2"} {
+			if strings.HasPrefix(layout, token) {
+				return ""
+			}
+		}
+		if layout[0] >= '1' && layout[0] <= '5' {
+			pattern.WriteString(`\d{1,2}`)
+		} else {
+			pattern.WriteString(regexp.QuoteMeta(layout[:1]))
+		}
+		layout = layout[1:]
+	}
+	return pattern.String() + "$"
+}
+
+func lowerBound(schema *Schema, t reflect.Type, param string, exclusive bool) {
+	switch t.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		n, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			return
+		}
+		if exclusive {
+			n++
+		}
+		switch t.Kind() {
+		case reflect.String:
+			schema.MinLength = &n
+		case reflect.Map:
+			schema.MinProperties = &n
+		default:
+			schema.MinItems = &n
+		}
+	default:
+		if f, err := strconv.ParseFloat(param, 64); err == nil && isNumber(t) {
+			schema.Minimum, schema.ExclusiveMinimum = &f, exclusive
+		}
+	}
+}
+
+func upperBound(schema *Schema, t reflect.Type, param string, exclusive bool) {
+	switch t.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		n, err := strconv.ParseUint(param, 10, 64)
+		if err != nil || (exclusive && n == 0) {
+			return
+		}
+		if exclusive {
+			n--
+		}
+		switch t.Kind() {
+		case reflect.String:
+			schema.MaxLength = &n
+		case reflect.Map:
+			schema.MaxProperties = &n
+		default:
+			schema.MaxItems = &n
+		}
+	default:
+		if f, err := strconv.ParseFloat(param, 64); err == nil && isNumber(t) {
+			schema.Maximum, schema.ExclusiveMaximum = &f, exclusive
+		}
+	}
+}
+
+func enumValue(t reflect.Type, value string) interface{} {
+	switch {
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Int64:
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	case t.Kind() >= reflect.Uint && t.Kind() <= reflect.Uint64:
+		if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return n
+		}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	case t.Kind() == reflect.Bool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+func isNumber(t reflect.Type) bool {
+	return t.Kind() >= reflect.Int && t.Kind() <= reflect.Float64
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,3 @@
+module github.com/awp0816/infrastructure/gm/openapi
+
+go 1.20
@@ -0,0 +1,146 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const Version = "3.0.3"
+
+// Schema OpenAPI 3 Schema Object,只包含由结构体及binding标签能推导出的字段
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     bool               `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     bool               `json:"exclusiveMaximum,omitempty"`
+	MinLength            *uint64            `json:"minLength,omitempty"`
+	MaxLength            *uint64            `json:"maxLength,omitempty"`
+	MinItems             *uint64            `json:"minItems,omitempty"`
+	MaxItems             *uint64            `json:"maxItems,omitempty"`
+	UniqueItems          bool               `json:"uniqueItems,omitempty"`
+	MinProperties        *uint64            `json:"minProperties,omitempty"`
+	MaxProperties        *uint64            `json:"maxProperties,omitempty"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"` //query|path|header|cookie
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type Operation struct {
+	Summary     string              `json:"summary,omitempty"`
+	OperationID string              `json:"operationId,omitempty"`
+	Tags        []string            `json:"tags,omitempty"`
+	Parameters  []Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas,omitempty"`
+}
+
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+	generator  *Generator
+}
+
+// NewDocument 创建文档,generator为空时使用默认生成器
+func NewDocument(info Info, generator *Generator) *Document {
+	if generator == nil {
+		generator = NewGenerator()
+	}
+	return &Document{
+		OpenAPI:   Version,
+		Info:      info,
+		Paths:     make(map[string]map[string]*Operation),
+		generator: generator,
+	}
+}
+
+/*
+AddOperation 添加接口,参数说明:
+
+	1、请求方法,GET/DELETE请求request按form标签生成query参数,其余请求生成json请求体
+	2、路径,如 /api/v1/example
+	3、接口描述
+	4、请求结构体,可为nil
+	5、响应结构体,可为nil
+*/
+func (d *Document) AddOperation(method, path, summary string, request, response interface{}) *Operation {
+	method = strings.ToUpper(method)
+	operation := &Operation{
+		Summary:   summary,
+		Responses: map[string]Response{},
+	}
+	if request != nil {
+		if method == http.MethodGet || method == http.MethodDelete {
+			operation.Parameters = d.generator.Parameters(request)
+		} else {
+			operation.RequestBody = &RequestBody{
+				Required: true,
+				Content: map[string]MediaType{
+					"application/json": {Schema: d.generator.Schema(request)},
+				},
+			}
+		}
+	}
+	ok := Response{Description: http.StatusText(http.StatusOK)}
+	if response != nil {
+		ok.Content = map[string]MediaType{
+			"application/json": {Schema: d.generator.Schema(response)},
+		}
+	}
+	operation.Responses["200"] = ok
+	if _, exist := d.Paths[path]; !exist {
+		d.Paths[path] = make(map[string]*Operation)
+	}
+	d.Paths[path][strings.ToLower(method)] = operation
+	return operation
+}
+
+// MarshalJSON 输出时同步生成器中的组件定义
+func (d *Document) MarshalJSON() ([]byte, error) {
+	type document Document
+	if d.generator != nil {
+		d.Components.Schemas = d.generator.Components()
+	}
+	return json.Marshal((*document)(d))
+}
@@ -0,0 +1,110 @@
+package response
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PageRequest 分页参数,sort为逗号分隔的排序字段,-前缀表示倒序,如 sort=-created_at,name
+type PageRequest struct {
+	Page   int     `form:"page" json:"page"`
+	Size   int     `form:"size" json:"size"`
+	Sort   string  `form:"sort" json:"sort"`
+	Orders []Order `form:"-" json:"-"`
+}
+
+type Order struct {
+	Column string //数据库列名
+	Desc   bool   //是否倒序
+}
+
+type PageOption struct {
+	DefaultSize int               //默认每页条数,默认10
+	MaxSize     int               //每页最大条数,默认100
+	Sortable    map[string]string //允许排序的字段,参数字段->数据库列名,为空则不允许排序
+	DefaultSort string            //未传sort时的排序,格式同sort
+}
+
+// PageResponse 分页结果
+type PageResponse[T any] struct {
+	Items []T   `json:"items"`
+	Total int64 `json:"total"`
+	Page  int   `json:"page"`
+	Size  int   `json:"size"`
+}
+
+// BindPage 绑定query中的分页参数,修正页码与条数范围,并按白名单解析排序字段
+func BindPage(c *gin.Context, option PageOption) (req PageRequest, err error) {
+	if err = c.ShouldBindQuery(&req); err != nil {
+		return
+	}
+	if option.DefaultSize <= 0 {
+		option.DefaultSize = 10
+	}
+	if option.MaxSize <= 0 {
+		option.MaxSize = 100
+	}
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.Size <= 0 {
+		req.Size = option.DefaultSize
+	}
+	if req.Size > option.MaxSize {
+		req.Size = option.MaxSize
+	}
+	if req.Sort == "" {
+		req.Sort = option.DefaultSort
+	}
+	for _, field := range strings.Split(req.Sort, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		desc := strings.HasPrefix(field, "-")
+		field = strings.TrimPrefix(field, "-")
+		column, ok := option.Sortable[field]
+		if !ok {
+			err = fmt.Errorf("sort field %s is not allowed", field)
+			return
+		}
+		req.Orders = append(req.Orders, Order{Column: column, Desc: desc})
+	}
+	return
+}
+
+// Offset 偏移量
+func (p PageRequest) Offset() int {
+	if p.Page <= 0 {
+		return 0
+	}
+	return (p.Page - 1) * p.Size
+}
+
+// Paginate 查询总数及当前页数据,db可预先设置Model/Table及查询条件,未设置时以T作为Model
+func Paginate[T any](db *gorm.DB, req PageRequest) (page PageResponse[T], err error) {
+	page.Page, page.Size = req.Page, req.Size
+	if db.Statement.Model == nil && db.Statement.Table == "" {
+		db = db.Model(new(T))
+	}
+	tx := db.Session(&gorm.Session{})
+	if err = tx.Count(&page.Total).Error; err != nil {
+		return
+	}
+	page.Items = make([]T, 0)
+	if page.Total == 0 || req.Offset() >= int(page.Total) {
+		return
+	}
+	query := tx
+	for _, order := range req.Orders {
+		query = query.Order(clause.OrderByColumn{Column: clause.Column{Name: order.Column}, Desc: order.Desc})
+	}
+	if req.Size > 0 {
+		query = query.Offset(req.Offset()).Limit(req.Size)
+	}
+	err = query.Find(&page.Items).Error
+	return
+}
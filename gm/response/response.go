@@ -0,0 +1,125 @@
+package response
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	CodeSuccess       = "000000" //成功
+	CodeInvalidParams = "000001" //参数错误
+	CodeUnauthorized  = "000401" //未登录
+	CodeForbidden     = "000403" //无权限
+	CodeNotFound      = "000404" //资源不存在
+	CodeServerError   = "001000" //服务异常
+)
+
+var (
+	// LanguageKey 请求上下文中保存语言的键,与valid.SetLanguage写入的键一致
+	LanguageKey = "language"
+	// DefaultLanguage 请求未设置语言或语言无对应文案时使用
+	DefaultLanguage = "zh"
+	messagesLock    sync.RWMutex
+	// messages 语言->错误码->文案
+	messages = map[string]map[string]string{
+		"zh": {
+			CodeSuccess:       "成功",
+			CodeInvalidParams: "参数错误",
+			CodeUnauthorized:  "未登录或登录已过期",
+			CodeForbidden:     "无访问权限",
+			CodeNotFound:      "资源不存在",
+			CodeServerError:   "服务异常,请联系管理员!",
+		},
+		"zh_Hant_TW": {
+			CodeSuccess:       "成功",
+			CodeInvalidParams: "參數錯誤",
+			CodeUnauthorized:  "未登入或登入已過期",
+			CodeForbidden:     "無存取權限",
+			CodeNotFound:      "資源不存在",
+			CodeServerError:   "服務異常,請聯絡管理員!",
+		},
+		"en": {
+			CodeSuccess:       "success",
+			CodeInvalidParams: "invalid parameters",
+			CodeUnauthorized:  "unauthorized",
+			CodeForbidden:     "forbidden",
+			CodeNotFound:      "resource not found",
+			CodeServerError:   "internal server error, please contact the administrator",
+		},
+		"ja": {
+			CodeSuccess:       "成功",
+			CodeInvalidParams: "パラメータエラー",
+			CodeUnauthorized:  "認証されていません",
+			CodeForbidden:     "アクセス権限がありません",
+			CodeNotFound:      "リソースが存在しません",
+			CodeServerError:   "サービス異常です。管理者に連絡してください",
+		},
+		"ko": {
+			CodeSuccess:       "성공",
+			CodeInvalidParams: "매개변수 오류",
+			CodeUnauthorized:  "인증되지 않았습니다",
+			CodeForbidden:     "접근 권한이 없습니다",
+			CodeNotFound:      "리소스가 존재하지 않습니다",
+			CodeServerError:   "서비스 오류, 관리자에게 문의하세요",
+		},
+	}
+)
+
+// Response 统一响应结构
+type Response[T any] struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Data    T      `json:"data"`
+}
+
+// RegisterMessage 注册或覆盖错误码在某语言下的文案
+func RegisterMessage(locale, code, message string) {
+	messagesLock.Lock()
+	defer messagesLock.Unlock()
+	if _, ok := messages[locale]; !ok {
+		messages[locale] = make(map[string]string)
+	}
+	messages[locale][code] = message
+}
+
+// Message 按请求语言获取错误码文案,无对应文案时使用默认语言,仍无则返回错误码
+func Message(c *gin.Context, code string) string {
+	messagesLock.RLock()
+	defer messagesLock.RUnlock()
+	if message, ok := messages[c.GetString(LanguageKey)][code]; ok {
+		return message
+	}
+	if message, ok := messages[DefaultLanguage][code]; ok {
+		return message
+	}
+	return code
+}
+
+// New 构造响应,message为空时按请求语言填充
+func New[T any](c *gin.Context, code, message string, data T) Response[T] {
+	if message == "" {
+		message = Message(c, code)
+	}
+	return Response[T]{
+		Code:    code,
+		Message: message,
+		Data:    data,
+	}
+}
+
+// Success 成功响应
+func Success[T any](c *gin.Context, data T) {
+	c.JSON(http.StatusOK, New(c, CodeSuccess, "", data))
+}
+
+// Error 失败响应并终止后续处理,与参数校验一致使用200状态码,data可为nil或错误明细
+func Error(c *gin.Context, code string, data interface{}) {
+	ErrorWithStatus(c, http.StatusOK, code, data)
+}
+
+// ErrorWithStatus 指定http状态码的失败响应
+func ErrorWithStatus(c *gin.Context, status int, code string, data interface{}) {
+	c.AbortWithStatusJSON(status, New(c, code, "", data))
+}